@@ -2,9 +2,9 @@ module pcap_scanner_go
 
 go 1.23.2
 
-require github.com/google/gopacket v1.1.19
-
 require (
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
-	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	github.com/google/gopacket v1.1.19
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
+	gopkg.in/yaml.v3 v3.0.1
 )
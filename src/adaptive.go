@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 自适应速率控制的窗口长度
+	adaptiveInterval = time.Second
+	// 用于计算基准响应比例的最近窗口数
+	adaptiveHistory = 5
+	// 窗口内发送的报文少于该值时不评估响应比例
+	adaptiveMinSamples = 100
+	// 响应比例低于基准的该比例时视为丢包
+	adaptiveRatioDrop = 0.7
+	// 响应比例不低于基准的该比例时计入滑动窗口
+	adaptiveRatioKeep = 0.9
+	// 窗口内实际发送量低于目标速率的该比例时不提高速率
+	adaptiveMinUtilization = 0.8
+)
+
+// captureStats 是监听器向自适应速率控制报告的计数，可被并发读写
+type captureStats struct {
+	responses atomic.Uint64 // 匹配到的响应报文数
+	dropped   atomic.Uint64 // 捕获缓冲区和网卡丢弃的捕获报文数
+}
+
+// rateSample 是一个控制窗口内各计数的增量
+type rateSample struct {
+	elapsed   time.Duration
+	sent      uint64 // 发送的报文数
+	errors    uint64 // 发送错误和发送队列已满的次数
+	dropped   uint64 // 捕获端丢弃的报文数
+	responses uint64 // 匹配到的响应数
+}
+
+// adaptiveRate 根据丢包信号在 [min, max] 范围内调整发送速率，类似TCP拥塞控制:
+// 慢启动阶段每个窗口速率翻倍，检测到丢包时速率减半并记为慢启动阈值，之后每个窗口按阈值的1/10线性增加
+type adaptiveRate struct {
+	min, max float64
+	rate     float64
+	ssthresh float64
+	ratios   []float64 // 最近几个无丢包窗口的响应比例
+}
+
+// newAdaptiveRate 创建自适应速率控制，从 start 开始慢启动
+func newAdaptiveRate(min, max, start float64) *adaptiveRate {
+	return &adaptiveRate{min: min, max: max, rate: start, ssthresh: max}
+}
+
+// update 根据一个窗口的计数调整速率，速率改变时输出日志，返回新的速率
+func (a *adaptiveRate) update(s rateSample) float64 {
+	old := a.rate
+	if reason := a.congestion(s); reason != "" {
+		a.ssthresh = math.Max(a.rate/2, a.min)
+		a.rate = a.ssthresh
+		if a.rate != old {
+			log.Printf("自适应速率: %s，发送速率从 %.0f 降至 %.0f pps。", reason, old, a.rate)
+		}
+		return a.rate
+	}
+
+	// 发送器未能达到当前速率 (例如CPU不足或报文即将发送完毕) 时不提高速率
+	if float64(s.sent) < adaptiveMinUtilization*a.rate*s.elapsed.Seconds() {
+		return a.rate
+	}
+	if a.rate < a.ssthresh {
+		a.rate = math.Min(a.rate*2, a.ssthresh)
+	} else {
+		a.rate += math.Max(a.ssthresh/10, 1)
+	}
+	a.rate = math.Min(a.rate, a.max)
+	if a.rate != old {
+		log.Printf("自适应速率: 未检测到丢包，发送速率从 %.0f 提高到 %.0f pps。", old, a.rate)
+	}
+	return a.rate
+}
+
+// congestion 判断窗口内是否出现丢包信号，返回原因，未出现时返回空字符串
+// 响应比例与滑动窗口中最近几个正常窗口的平均值比较
+func (a *adaptiveRate) congestion(s rateSample) string {
+	var reasons []string
+	if s.errors > 0 {
+		reasons = append(reasons, fmt.Sprintf("发送错误 %d 次", s.errors))
+	}
+	if s.dropped > 0 {
+		reasons = append(reasons, fmt.Sprintf("捕获端丢弃 %d 个报文", s.dropped))
+	}
+	if s.sent < adaptiveMinSamples {
+		return strings.Join(reasons, "，")
+	}
+
+	ratio := float64(s.responses) / float64(s.sent)
+	var base float64
+	if len(a.ratios) >= adaptiveHistory/2+1 {
+		for _, r := range a.ratios {
+			base += r
+		}
+		base /= float64(len(a.ratios))
+		if base > 0 && ratio < base*adaptiveRatioDrop {
+			reasons = append(reasons, fmt.Sprintf("响应比例从 %.1f%% 降至 %.1f%%", base*100, ratio*100))
+		}
+	}
+	// 明显低于基准的窗口不计入滑动窗口，避免响应比例逐渐下降时基准随之下降
+	if len(reasons) == 0 && ratio >= base*adaptiveRatioKeep {
+		a.ratios = append(a.ratios, ratio)
+		if len(a.ratios) > adaptiveHistory {
+			a.ratios = a.ratios[1:]
+		}
+	}
+	return strings.Join(reasons, "，")
+}
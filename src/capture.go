@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// 接收后端
+const (
+	rxBackendPcap   = "pcap"   // 通过libpcap捕获
+	rxBackendRXRing = "rxring" // 通过AF_PACKET TPACKET_V3 接收环捕获 (仅Linux)
+)
+
+const (
+	// 捕获的最大报文长度
+	captureSnaplen = 1600
+	// 读取报文的超时时间，超时后监听器检查发送器是否已完成
+	captureTimeout = 100 * time.Millisecond
+)
+
+// errCaptureTimeout 表示在读取超时时间内没有收到报文
+var errCaptureTimeout = errors.New("读取报文超时")
+
+// captureSource 是捕获响应的后端
+// ZeroCopyReadPacketData 返回的数据直接引用后端的缓冲区，只在下一次调用之前有效；没有报文时返回 errCaptureTimeout
+// Drops 返回捕获缓冲区 (libpcap缓冲区或接收环) 已满、用户空间读取跟不上时丢弃的报文数，
+// 以及网卡丢弃的报文数 (后端不支持时为0)
+type captureSource interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	Drops() (queue, iface uint64, err error)
+	Close()
+}
+
+// pcapSource 通过libpcap捕获报文
+type pcapSource struct {
+	handle *pcap.Handle
+}
+
+func (s *pcapSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.handle.ZeroCopyReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = errCaptureTimeout
+	}
+	return data, ci, err
+}
+
+func (s *pcapSource) LinkType() layers.LinkType {
+	return s.handle.LinkType()
+}
+
+func (s *pcapSource) Drops() (uint64, uint64, error) {
+	stats, err := s.handle.Stats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(stats.PacketsDropped), uint64(stats.PacketsIfDropped), nil
+}
+
+func (s *pcapSource) Close() {
+	s.handle.Close()
+}
+
+// openPcapSource 打开网络接口用于通过libpcap捕获，并应用BPF过滤器
+func openPcapSource(ifaceName, filter string) (*pcapSource, error) {
+	handle, err := pcap.OpenLive(ifaceName, captureSnaplen, true, captureTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("设置BPF过滤器时出错: %v", err)
+	}
+	return &pcapSource{handle: handle}, nil
+}
+
+// openCaptureSource 按指定的后端打开捕获接口，接收环不可用时回退到libpcap
+// vlanDepth 大于0时接收环会将内核剥离的VLAN标签重新插入报文
+// 返回实际使用的后端名称
+func openCaptureSource(backend, ifaceName, filter string, vlanDepth int) (captureSource, string, error) {
+	switch backend {
+	case rxBackendPcap:
+	case rxBackendRXRing:
+		s, err := openRXRingSource(ifaceName, filter, vlanDepth > 0)
+		if err == nil {
+			return s, rxBackendRXRing, nil
+		}
+		log.Printf("警告: 无法在接口 %s 上创建接收环: %v，回退到libpcap捕获。", ifaceName, err)
+	default:
+		return nil, "", fmt.Errorf("不支持的接收后端: %s (可选: %s, %s)", backend, rxBackendPcap, rxBackendRXRing)
+	}
+	s, err := openPcapSource(ifaceName, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, rxBackendPcap, nil
+}
+
+// parseCaptureIfaces 解析逗号分隔的捕获接口列表
+func parseCaptureIfaces(spec string) ([]string, error) {
+	var ifaces []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("无效的捕获接口列表: %q", spec)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("捕获接口 %s 重复", name)
+		}
+		seen[name] = true
+		ifaces = append(ifaces, name)
+	}
+	return ifaces, nil
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// 目标地址或目标网段的数量不超过该值时，捕获过滤器按源地址过滤
+	captureFilterMaxSources = 16
+	// 源端口连续区间的数量超过该值时，捕获过滤器改用覆盖全部端口的单个区间
+	captureFilterMaxPortRanges = 8
+)
+
+// portRange 是闭区间 [first, last] 内的端口
+type portRange struct {
+	first, last uint16
+}
+
+// captureFilterPlan 汇总探测计划中会产生响应的协议和我们使用的源端口
+type captureFilterPlan struct {
+	tcpPorts  map[uint16]bool
+	udpPorts  map[uint16]bool
+	sctpPorts map[uint16]bool
+	sctpInit  bool // SCTP INIT探测的源端口由发送器在 sctpSrcPortBase 起的区间内分配
+	echo      bool
+	protocols map[layers.IPProtocol]bool // 其他协议，按协议号匹配
+}
+
+// buildCaptureFilter 根据探测计划生成捕获过滤器，只接收发往源IP的以下报文:
+// 来自目标 (目标较少时) 且属于探测使用的协议、发往我们使用的源端口的响应，承载UDP的IP分片，以及任意来源的ICMP差错报文
+// 任何模板无法解析时，退化为只按目的地址过滤
+func buildCaptureFilter(srcIP net.IP, plan []probeGroup) string {
+	base := fmt.Sprintf("dst host %s", srcIP.String())
+	ipv4 := srcIP.To4() != nil
+
+	p := captureFilterPlan{
+		tcpPorts:  make(map[uint16]bool),
+		udpPorts:  make(map[uint16]bool),
+		sctpPorts: make(map[uint16]bool),
+		protocols: make(map[layers.IPProtocol]bool),
+	}
+	for _, group := range plan {
+		for i := range group.templates {
+			probe, err := extractProbeLayers(group.templates[i].Packet)
+			if err != nil {
+				log.Printf("警告: 模板 %s: %v，捕获过滤器只按目的地址过滤。", group.templates[i].name(), err)
+				return base
+			}
+			p.add(probe.summary())
+		}
+	}
+
+	var responses []string
+	responses = append(responses, portClauses("tcp", p.tcpPorts)...)
+	if len(p.udpPorts) > 0 {
+		responses = append(responses, portClauses("udp", p.udpPorts)...)
+		// 大的UDP响应会被分片，后续分片不含UDP头，只能按分片标志匹配
+		if ipv4 {
+			responses = append(responses, "(ip proto 17 and ip[6:2] & 0x1fff != 0)")
+		} else {
+			responses = append(responses, "(ip6[6] == 44 and ip6[40] == 17)")
+		}
+	}
+	if p.sctpInit {
+		responses = append(responses, fmt.Sprintf("sctp dst portrange %d-%d", sctpSrcPortBase, sctpSrcPortBase+sctpSrcPortSpan-1))
+	}
+	responses = append(responses, portClauses("sctp", p.sctpPorts)...)
+	if p.echo {
+		if ipv4 {
+			responses = append(responses, "icmp[icmptype] == icmp-echoreply")
+		} else {
+			responses = append(responses, "(icmp6 and ip6[40] == 129)")
+		}
+	}
+	protocols := make([]int, 0, len(p.protocols))
+	for proto := range p.protocols {
+		protocols = append(protocols, int(proto))
+	}
+	sort.Ints(protocols)
+	for _, proto := range protocols {
+		if ipv4 {
+			responses = append(responses, fmt.Sprintf("ip proto %d", proto))
+		} else {
+			responses = append(responses, fmt.Sprintf("ip6 proto %d", proto))
+		}
+	}
+	if len(responses) == 0 {
+		return base
+	}
+
+	filter := strings.Join(responses, " or ")
+	if sources := sourceClause(plan); sources != "" {
+		filter = fmt.Sprintf("(%s) and (%s)", sources, filter)
+	}
+	// ICMP差错报文可能由路径上的路由器发出，不按源地址过滤
+	if ipv4 {
+		filter = fmt.Sprintf("(%s) or icmp[icmptype] == icmp-unreach or icmp[icmptype] == icmp-timxceed or icmp[icmptype] == icmp-paramprob", filter)
+	} else {
+		filter = fmt.Sprintf("(%s) or (icmp6 and ip6[40] >= 1 and ip6[40] <= 4)", filter)
+	}
+	return fmt.Sprintf("%s and (%s)", base, filter)
+}
+
+// add 记录一个模板的探测报文会产生的响应
+func (p *captureFilterPlan) add(s probeSummary) {
+	switch {
+	case s.echo:
+		p.echo = true
+	case s.sctpInit:
+		p.sctpInit = true
+	case s.proto == layers.IPProtocolSCTP:
+		p.sctpPorts[s.srcPort] = true
+	case s.proto == layers.IPProtocolTCP:
+		p.tcpPorts[s.srcPort] = true
+	case s.proto == layers.IPProtocolUDP:
+		p.udpPorts[s.srcPort] = true
+	default:
+		// 其他协议 (包括非回显的ICMP探测，如时间戳请求) 按协议号匹配全部响应
+		p.protocols[s.proto] = true
+	}
+}
+
+// portClauses 生成匹配发往指定源端口的响应的过滤表达式，连续的端口合并为区间
+func portClauses(proto string, ports map[uint16]bool) []string {
+	if len(ports) == 0 {
+		return nil
+	}
+	ranges := portRanges(ports)
+	if len(ranges) > captureFilterMaxPortRanges {
+		ranges = []portRange{{ranges[0].first, ranges[len(ranges)-1].last}}
+	}
+	clauses := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		if r.first == r.last {
+			clauses = append(clauses, fmt.Sprintf("%s dst port %d", proto, r.first))
+		} else {
+			clauses = append(clauses, fmt.Sprintf("%s dst portrange %d-%d", proto, r.first, r.last))
+		}
+	}
+	return clauses
+}
+
+// portRanges 将端口集合按升序合并为连续区间
+func portRanges(ports map[uint16]bool) []portRange {
+	sorted := make([]int, 0, len(ports))
+	for port := range ports {
+		sorted = append(sorted, int(port))
+	}
+	sort.Ints(sorted)
+	var ranges []portRange
+	for _, port := range sorted {
+		if n := len(ranges); n > 0 && int(ranges[n-1].last)+1 == port {
+			ranges[n-1].last = uint16(port)
+			continue
+		}
+		ranges = append(ranges, portRange{uint16(port), uint16(port)})
+	}
+	return ranges
+}
+
+// sourceClause 按目标地址生成源地址过滤表达式
+// 目标较多时按网段 (IPv4 /24、IPv6 /64) 合并，网段仍然过多时返回空字符串，不按源地址过滤
+func sourceClause(plan []probeGroup) string {
+	hosts := make(map[netip.Addr]bool)
+	for _, group := range plan {
+		for _, ip := range group.targets {
+			hosts[addrFromIP(ip)] = true
+		}
+	}
+	if len(hosts) <= captureFilterMaxSources {
+		addrs := make([]netip.Addr, 0, len(hosts))
+		for addr := range hosts {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+		clauses := make([]string, len(addrs))
+		for i, addr := range addrs {
+			clauses[i] = "src host " + addr.String()
+		}
+		return strings.Join(clauses, " or ")
+	}
+
+	prefixes := make(map[netip.Prefix]bool)
+	for addr := range hosts {
+		bits := 64
+		if addr.Is4() {
+			bits = 24
+		}
+		prefix, _ := addr.Prefix(bits)
+		prefixes[prefix] = true
+		if len(prefixes) > captureFilterMaxSources {
+			return ""
+		}
+	}
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for prefix := range prefixes {
+		sorted = append(sorted, prefix)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Addr().Less(sorted[j].Addr()) })
+	clauses := make([]string, len(sorted))
+	for i, prefix := range sorted {
+		clauses[i] = "src net " + prefix.String()
+	}
+	return strings.Join(clauses, " or ")
+}
@@ -0,0 +1,172 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// compileCaptureFilter 按接收时的方式 (包括VLAN标签) 编译捕获过滤器，libpcap不可用时跳过
+func compileCaptureFilter(t *testing.T, expr string) {
+	t.Helper()
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, captureSnaplen, "ip"); err != nil {
+		t.Skipf("libpcap不可用，无法编译过滤器: %v", err)
+	}
+	for depth := 0; depth <= 2; depth++ {
+		if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, captureSnaplen, vlanAwareFilter(expr, depth)); err != nil {
+			t.Errorf("VLAN层数 %d: 无法编译过滤器 %q: %v", depth, expr, err)
+		}
+	}
+}
+
+// testTargets 返回 base 之后连续的 n 个地址
+func testTargets(base string, n int) []net.IP {
+	ip := addrFromIP(net.ParseIP(base))
+	targets := make([]net.IP, n)
+	for i := range targets {
+		targets[i] = net.IP(ip.AsSlice())
+		ip = ip.Next()
+	}
+	return targets
+}
+
+func TestBuildCaptureFilter(t *testing.T) {
+	tcp := func(port layers.TCPPort) *layers.TCP {
+		l := testTCP(false)
+		l.SrcPort = port
+		return l
+	}
+	tcp4 := func(port layers.TCPPort) PacketTemplate {
+		return testTemplate(t, testIPv4(layers.IPProtocolTCP), tcp(port))
+	}
+	udp4 := testTemplate(t, testIPv4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 53000, DstPort: 53}, testDNS())
+	echo4 := testTemplate(t, testIPv4(layers.IPProtocolICMPv4),
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}, gopacket.Payload("abcd"))
+	sctp4 := testTemplate(t, testIPv4(layers.IPProtocolSCTP), testSCTPInit()...)
+	tcp6 := testTemplate(t, testIPv6(layers.IPProtocolTCP), tcp(40000))
+	udp6 := testTemplate(t, testIPv6(layers.IPProtocolUDP), &layers.UDP{SrcPort: 53000, DstPort: 53}, testDNS())
+	echo6 := testTemplate(t, testIPv6(layers.IPProtocolICMPv6),
+		&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)},
+		&layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1}, gopacket.Payload("abcd"))
+
+	// 9个不连续的TCP源端口超过区间数量上限，合并为覆盖全部端口的单个区间
+	var manyPorts []PacketTemplate
+	for i := 0; i < captureFilterMaxPortRanges+1; i++ {
+		manyPorts = append(manyPorts, tcp4(layers.TCPPort(1000+10*i)))
+	}
+
+	src4, src6 := net.IP{198, 51, 100, 1}, net.ParseIP("2001:db8:1::1")
+	cases := []struct {
+		name     string
+		srcIP    net.IP
+		plan     []probeGroup
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "IPv4 TCP端口区间",
+			srcIP:    src4,
+			plan:     []probeGroup{{targets: testTargets("203.0.113.1", 2), templates: []PacketTemplate{tcp4(40000), tcp4(40001), tcp4(40002), tcp4(40010)}}},
+			contains: []string{"dst host 198.51.100.1", "tcp dst portrange 40000-40002", "tcp dst port 40010", "src host 203.0.113.1 or src host 203.0.113.2", "icmp[icmptype] == icmp-unreach"},
+		},
+		{
+			name:     "IPv4 端口区间过多",
+			srcIP:    src4,
+			plan:     []probeGroup{{targets: testTargets("203.0.113.1", 1), templates: manyPorts}},
+			contains: []string{fmt.Sprintf("tcp dst portrange 1000-%d", 1000+10*captureFilterMaxPortRanges)},
+			excludes: []string{"tcp dst port 1000 "},
+		},
+		{
+			name:     "IPv4 UDP分片、回显和SCTP INIT",
+			srcIP:    src4,
+			plan:     []probeGroup{{targets: testTargets("203.0.113.1", 1), templates: []PacketTemplate{udp4, echo4, sctp4}}},
+			contains: []string{"udp dst port 53000", "(ip proto 17 and ip[6:2] & 0x1fff != 0)", "icmp[icmptype] == icmp-echoreply", fmt.Sprintf("sctp dst portrange %d-%d", sctpSrcPortBase, sctpSrcPortBase+sctpSrcPortSpan-1)},
+		},
+		{
+			name:     "IPv4 目标较多时按网段过滤",
+			srcIP:    src4,
+			plan:     []probeGroup{{targets: append(testTargets("203.0.113.1", 20), testTargets("192.0.2.1", 20)...), templates: []PacketTemplate{tcp4(40000)}}},
+			contains: []string{"src net 192.0.2.0/24 or src net 203.0.113.0/24"},
+			excludes: []string{"src host"},
+		},
+		{
+			name:     "IPv4 网段过多时不按源地址过滤",
+			srcIP:    src4,
+			plan:     []probeGroup{{targets: testTargets("10.0.0.1", 256*(captureFilterMaxSources+1)), templates: []PacketTemplate{tcp4(40000)}}},
+			excludes: []string{"src host", "src net"},
+		},
+		{
+			name:     "IPv6 TCP、UDP分片和回显",
+			srcIP:    src6,
+			plan:     []probeGroup{{targets: testTargets("2001:db8:ffff::1", 3), templates: []PacketTemplate{tcp6, udp6, echo6}}},
+			contains: []string{"dst host 2001:db8:1::1", "tcp dst port 40000", "(ip6[6] == 44 and ip6[40] == 17)", "(icmp6 and ip6[40] == 129)", "src host 2001:db8:ffff::1", "(icmp6 and ip6[40] >= 1 and ip6[40] <= 4)"},
+		},
+		{
+			name:     "IPv6 目标较多时按网段过滤",
+			srcIP:    src6,
+			plan:     []probeGroup{{targets: testTargets("2001:db8:ffff::1", 40), templates: []PacketTemplate{tcp6}}},
+			contains: []string{"src net 2001:db8:ffff::/64"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := buildCaptureFilter(tc.srcIP, tc.plan)
+			for _, s := range tc.contains {
+				if !strings.Contains(filter, s) {
+					t.Errorf("过滤器缺少 %q: %s", s, filter)
+				}
+			}
+			for _, s := range tc.excludes {
+				if strings.Contains(filter, s) {
+					t.Errorf("过滤器不应包含 %q: %s", s, filter)
+				}
+			}
+			compileCaptureFilter(t, filter)
+		})
+	}
+}
+
+func TestPortRanges(t *testing.T) {
+	cases := []struct {
+		ports []uint16
+		want  []portRange
+	}{
+		{[]uint16{80}, []portRange{{80, 80}}},
+		{[]uint16{3, 1, 2, 5}, []portRange{{1, 3}, {5, 5}}},
+		{[]uint16{0, 65535}, []portRange{{0, 0}, {65535, 65535}}},
+		{[]uint16{65534, 65535}, []portRange{{65534, 65535}}},
+	}
+	for _, tc := range cases {
+		ports := make(map[uint16]bool)
+		for _, p := range tc.ports {
+			ports[p] = true
+		}
+		if got := portRanges(ports); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("portRanges(%v) = %v，期望 %v", tc.ports, got, tc.want)
+		}
+	}
+}
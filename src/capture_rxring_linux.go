@@ -0,0 +1,133 @@
+//go:build linux
+
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 接收环中每个块的大小，内核填满一个块 (或块超时) 后才将其交给用户空间
+	rxRingBlockSize = 1 << 20
+	// 接收环中的块数量，共64MB
+	rxRingBlocks = 64
+)
+
+// rxRingSource 通过AF_PACKET TPACKET_V3 接收环捕获报文
+// 内核将报文直接写入与用户空间共享的环形缓冲区，读取报文不需要系统调用和复制
+type rxRingSource struct {
+	tpacket *afpacket.TPacket
+	promisc int // 保持接口处于混杂模式的套接字
+}
+
+// openRXRingSource 在指定接口上创建接收环并应用BPF过滤器
+// addVLAN 为true时将内核剥离的VLAN标签重新插入报文，以便解码和写入pcap文件
+func openRXRingSource(ifaceName, filter string, addVLAN bool) (*rxRingSource, error) {
+	tpacket, err := afpacket.NewTPacket(
+		afpacket.OptInterface(ifaceName),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(rxRingBlockSize),
+		afpacket.OptNumBlocks(rxRingBlocks),
+		afpacket.OptPollTimeout(captureTimeout),
+		afpacket.OptAddVLANHeader(addVLAN),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// 接收环没有自己的过滤器编译器，使用libpcap将过滤表达式编译为BPF指令后附加到套接字
+	insns, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, captureSnaplen, filter)
+	if err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("编译BPF过滤器时出错: %v", err)
+	}
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, insn := range insns {
+		raw[i] = bpf.RawInstruction{Op: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	if err := tpacket.SetBPF(raw); err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("设置BPF过滤器时出错: %v", err)
+	}
+
+	promisc, err := enablePromisc(ifaceName)
+	if err != nil {
+		tpacket.Close()
+		return nil, err
+	}
+	return &rxRingSource{tpacket: tpacket, promisc: promisc}, nil
+}
+
+// enablePromisc 使接口进入混杂模式，与libpcap后端一致，返回持有混杂模式成员资格的套接字
+// afpacket 不会设置混杂模式，在镜像端口上捕获时发往其他MAC地址的响应会被网卡过滤；
+// 成员资格在套接字关闭时由内核撤销，因此不会影响其他程序或在退出后遗留混杂模式。
+// 该套接字的协议号为0，不接收任何报文
+func enablePromisc(ifaceName string) (int, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return -1, fmt.Errorf("创建AF_PACKET套接字失败: %v", err)
+	}
+	mreq := unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_PROMISC}
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("设置接口 %s 为混杂模式失败: %v", ifaceName, err)
+	}
+	return fd, nil
+}
+
+func (s *rxRingSource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.tpacket.ZeroCopyReadPacketData()
+	if err == afpacket.ErrTimeout {
+		err = errCaptureTimeout
+	}
+	return data, ci, err
+}
+
+// LinkType 总是返回以太网: 接收环使用原始套接字，报文包含完整的链路层头
+func (s *rxRingSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// Drops 返回接收环没有空闲块 (用户空间读取跟不上) 时丢弃的报文数，接收环不提供网卡丢弃的统计
+func (s *rxRingSource) Drops() (uint64, uint64, error) {
+	_, stats, err := s.tpacket.SocketStats()
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(stats.Drops()), 0, nil
+}
+
+func (s *rxRingSource) Close() {
+	s.tpacket.Close()
+	unix.Close(s.promisc)
+}
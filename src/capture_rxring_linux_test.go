@@ -0,0 +1,66 @@
+//go:build linux
+
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// isPromisc 判断接口当前是否处于混杂模式
+func isPromisc(t *testing.T, ifaceName string) bool {
+	t.Helper()
+	// net.Flags 不包含 IFF_PROMISC，从sysfs读取接口标志
+	data, err := os.ReadFile("/sys/class/net/" + ifaceName + "/flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags&unix.IFF_PROMISC != 0
+}
+
+func TestRXRingEnablesPromisc(t *testing.T) {
+	const iface, peer = "pcsrx0", "pcsrx1"
+	setupTestVeth(t, iface, peer)
+	if isPromisc(t, iface) {
+		t.Fatalf("接口 %s 在测试开始时已处于混杂模式", iface)
+	}
+
+	// 接收环通过 enablePromisc 持有混杂模式成员资格，关闭接收环时关闭该套接字
+	fd, err := enablePromisc(iface)
+	if err != nil {
+		t.Fatalf("设置混杂模式失败: %v", err)
+	}
+	if !isPromisc(t, iface) {
+		t.Error("设置后接口未进入混杂模式")
+	}
+	unix.Close(fd)
+	if isPromisc(t, iface) {
+		t.Error("套接字关闭后接口仍处于混杂模式")
+	}
+}
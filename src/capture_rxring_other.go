@@ -0,0 +1,33 @@
+//go:build !linux
+
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import "errors"
+
+// rxRingSource 仅在Linux上可用
+type rxRingSource struct {
+	captureSource
+}
+
+// openRXRingSource 在非Linux系统上总是失败，调用方回退到libpcap捕获
+func openRXRingSource(ifaceName, filter string, addVLAN bool) (*rxRingSource, error) {
+	return nil, errors.New("接收环仅支持Linux")
+}
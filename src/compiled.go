@@ -0,0 +1,354 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// SCTP校验和使用的CRC32c表
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// compiledTemplate 是预编译的模板帧及需要逐个探测报文修补的字段偏移
+// 每个探测报文只需复制帧并修补目的MAC、目的IP和探测标识等字段，校验和按 RFC 1624 增量更新
+type compiledTemplate struct {
+	frame   []byte       // 完整的以太网帧，目的MAC和目的IP为0
+	summary probeSummary // 会话跟踪信息，端口等字段在编译时确定
+
+	ip4    bool
+	ipOff  int // 最外层IP头的偏移
+	ipEnd  int // IP报文结束的偏移 (之后可能是以太网填充)
+	l4Off  int // 传输层 (TCP, UDP, SCTP, ICMP) 的偏移，-1 表示没有
+	l4Sum  int // 传输层校验和的偏移，-1 表示没有
+	pseudo bool
+
+	echoOff int // ICMP回显标识符的偏移
+	tsOff   int // TCP时间戳选项数据的偏移，-1 表示没有
+	sackOff int // TCP SACK选项数据的偏移
+	sackLen int // TCP SACK选项数据的长度
+	initOff int // SCTP INIT块的偏移
+	dnsOff  int // DNS报文头的偏移
+}
+
+// compileTemplate 将模板预编译为以太网帧并记录各字段偏移
+// 需要改变报文长度 (载荷占位符、DNS查询名称) 或包含隧道等多层IP的模板无法预编译，返回nil，由发送器逐个序列化
+func compileTemplate(template *PacketTemplate, srcIP net.IP, srcMAC net.HardwareAddr, vlanIDs []uint16, overrides *headerOverrides, dnsName string) *compiledTemplate {
+	probe, err := extractProbeLayers(template.Packet)
+	if err != nil {
+		return nil
+	}
+	for _, layer := range probe.stack {
+		if payload, ok := rawPayload(layer); ok && hasPlaceholders(payload) {
+			return nil
+		}
+	}
+	if probe.dns != nil && dnsName != "" {
+		return nil
+	}
+
+	dstIP := net.IPv6zero
+	if srcIP.To4() != nil {
+		dstIP = net.IPv4zero.To4()
+	}
+	if err := probe.rewriteAddresses(srcIP, dstIP); err != nil {
+		return nil
+	}
+	// 固定的覆盖值直接写入帧中，随机的覆盖值在每个探测报文中修补
+	probe.applyOverrides(overrides)
+	// 按逐个序列化的方式规范化探测标识 (清零SCTP验证标签、未置ACK时的TSecr等)，使修补后的帧与之完全一致
+	probe.applyIdentity(&probeIdentity{})
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, probeFrameLayers(probe, template.Packet, srcMAC, make(net.HardwareAddr, 6), vlanIDs)...); err != nil {
+		return nil
+	}
+
+	c := &compiledTemplate{
+		frame:   append([]byte(nil), buffer.Bytes()...),
+		summary: probe.summary(),
+		ipOff:   -1,
+		l4Off:   -1,
+		l4Sum:   -1,
+		tsOff:   -1,
+	}
+
+	// 重新解码编译得到的帧，按各层长度累加得到偏移
+	packet := gopacket.NewPacket(c.frame, layers.LayerTypeEthernet, gopacket.NoCopy)
+	offset := 0
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4, *layers.IPv6:
+			if c.ipOff >= 0 {
+				return nil // 隧道内层的校验和依赖内层IP，不做增量更新
+			}
+			c.ipOff = offset
+			if ip4, ok := l.(*layers.IPv4); ok {
+				c.ip4 = true
+				c.ipEnd = offset + int(ip4.Length)
+			} else {
+				c.ipEnd = offset + 40 + int(l.(*layers.IPv6).Length)
+			}
+		case *layers.TCP:
+			if c.l4Off < 0 {
+				c.l4Off, c.l4Sum, c.pseudo = offset, offset+16, true
+				c.findTCPOptions(l, offset)
+			}
+		case *layers.UDP:
+			if c.l4Off < 0 {
+				c.l4Off, c.l4Sum, c.pseudo = offset, offset+6, true
+			}
+		case *layers.SCTP:
+			if c.l4Off < 0 {
+				c.l4Off = offset
+			}
+		case *layers.SCTPInit:
+			if c.initOff == 0 {
+				c.initOff = offset
+			}
+		case *layers.ICMPv4:
+			if c.l4Off < 0 {
+				c.l4Off, c.l4Sum, c.echoOff = offset, offset+2, offset+4
+			}
+		case *layers.ICMPv6:
+			if c.l4Off < 0 {
+				c.l4Off, c.l4Sum, c.echoOff, c.pseudo = offset, offset+2, offset+4, true
+			}
+		case *layers.DNS:
+			if c.dnsOff == 0 {
+				c.dnsOff = offset
+			}
+		default:
+			// 其他依赖伪首部计算校验和的协议无法增量更新
+			if _, ok := layer.(checksumLayer); ok {
+				return nil
+			}
+		}
+		offset += len(layer.LayerContents())
+	}
+
+	// 校验和按16位字计算，要求各校验范围在帧中从偶数偏移开始
+	if c.ipOff < 0 || c.ipOff%2 != 0 || c.l4Off%2 != 0 {
+		return nil
+	}
+	s := c.summary
+	if (s.echo || s.tcp) && c.l4Off < 0 || s.sctpInit && c.initOff == 0 || s.dns && c.dnsOff == 0 {
+		return nil
+	}
+	return c
+}
+
+// findTCPOptions 在TCP选项中查找时间戳和SACK选项数据的偏移
+func (c *compiledTemplate) findTCPOptions(tcp *layers.TCP, tcpOff int) {
+	opts := tcp.Contents[20:]
+	for i := 0; i < len(opts); {
+		kind := layers.TCPOptionKind(opts[i])
+		if kind == layers.TCPOptionKindEndList {
+			return
+		}
+		if kind == layers.TCPOptionKindNop {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return
+		}
+		length := int(opts[i+1])
+		switch {
+		case kind == layers.TCPOptionKindTimestamps && length == 10:
+			c.tsOff = tcpOff + 20 + i + 2
+		case kind == layers.TCPOptionKindSACK:
+			c.sackOff, c.sackLen = tcpOff+20+i+2, (length-2)&^3
+		}
+		i += length
+	}
+}
+
+// checkTarget 检查目标地址与模板的IP版本是否一致，错误信息与 rewriteAddresses 相同
+// build 按模板的地址长度修补目的IP，不一致的目标必须在调用 build 之前排除
+func (c *compiledTemplate) checkTarget(srcIP, dstIP net.IP) error {
+	if c.ip4 && dstIP.To4() == nil {
+		return fmt.Errorf("IPv4模板无法发送到 %s (源地址 %s)", dstIP, srcIP)
+	}
+	if !c.ip4 && dstIP.To4() != nil {
+		return fmt.Errorf("IPv6模板无法发送到 %s (源地址 %s)", dstIP, srcIP)
+	}
+	return nil
+}
+
+// build 将预编译的帧复制到 buf 中，并修补目的MAC、目的IP、覆盖字段和探测标识，返回完整的帧
+// buf 在多个探测报文之间复用，不产生逐个报文的内存分配
+func (c *compiledTemplate) build(buf []byte, dstMAC net.HardwareAddr, dstIP net.IP, id *probeIdentity, overrides *headerOverrides) []byte {
+	frame := append(buf[:0], c.frame...)
+	copy(frame[0:6], dstMAC)
+
+	ipSum, pseudoSum := -1, -1
+	if c.ip4 {
+		ipSum = c.ipOff + 10
+	}
+	if c.pseudo {
+		pseudoSum = c.l4Sum
+	}
+	if c.ip4 {
+		patchBytes(frame, c.ipOff+16, dstIP.To4(), ipSum, pseudoSum)
+	} else {
+		patchBytes(frame, c.ipOff+24, dstIP.To16(), pseudoSum)
+	}
+	c.patchOverrides(frame, overrides)
+
+	s := &c.summary
+	if s.echo {
+		patch16(frame, c.echoOff, id.echoID, c.l4Sum)
+		patch16(frame, c.echoOff+2, id.echoSeq, c.l4Sum)
+	}
+	if s.tcp {
+		c.patchTCP(frame, id)
+	}
+	if s.dns {
+		patch16(frame, c.dnsOff, id.dnsID, c.l4Sum)
+	}
+	if s.sctpInit {
+		// SCTP使用CRC32c校验和，无法增量更新，修补后重新计算
+		patch16(frame, c.l4Off, id.sctpPort)
+		patch32(frame, c.initOff+4, id.sctpTag)
+		sctp := frame[c.l4Off:c.ipEnd]
+		binary.LittleEndian.PutUint32(sctp[8:12], 0)
+		binary.LittleEndian.PutUint32(sctp[8:12], crc32.Checksum(sctp, castagnoliTable))
+	}
+
+	// UDP校验和为0表示未计算校验和，计算结果为0时应填写0xFFFF
+	if s.proto == layers.IPProtocolUDP && c.l4Sum >= 0 && frame[c.l4Sum] == 0 && frame[c.l4Sum+1] == 0 {
+		frame[c.l4Sum], frame[c.l4Sum+1] = 0xff, 0xff
+	}
+	return frame
+}
+
+// patchTCP 修补TCP序列号、确认号、时间戳和SACK选项，语义与 setTCPIdentity 相同
+func (c *compiledTemplate) patchTCP(frame []byte, id *probeIdentity) {
+	tcp := c.l4Off
+	patch32(frame, tcp+4, id.tcpSeq, c.l4Sum)
+	if c.summary.tcpAckSet {
+		delta := id.tcpAck - binary.BigEndian.Uint32(frame[tcp+8:])
+		patch32(frame, tcp+8, id.tcpAck, c.l4Sum)
+		for off := c.sackOff; off < c.sackOff+c.sackLen; off += 4 {
+			patch32(frame, off, binary.BigEndian.Uint32(frame[off:])+delta, c.l4Sum)
+		}
+	}
+	if c.tsOff >= 0 {
+		patch32(frame, c.tsOff, id.tsval, c.l4Sum)
+		if c.summary.tcpAckSet {
+			patch32(frame, c.tsOff+4, id.tsecr, c.l4Sum)
+		}
+	}
+}
+
+// patchOverrides 修补每个探测报文随机取值的报文头覆盖字段，固定的覆盖值已在编译时写入
+func (c *compiledTemplate) patchOverrides(frame []byte, o *headerOverrides) {
+	if o == nil {
+		return
+	}
+	ip := c.ipOff
+	if c.ip4 {
+		if o.ttl.random() {
+			patch8(frame, ip+8, uint8(o.ttl.value()), ip+10)
+		}
+		if o.tos.random() {
+			patch8(frame, ip+1, uint8(o.tos.value()), ip+10)
+		}
+		if o.df.random() {
+			flags := frame[ip+6] &^ 0x40
+			if o.df.value() == 1 {
+				flags |= 0x40
+			}
+			patch8(frame, ip+6, flags, ip+10)
+		}
+	} else {
+		// IPv6头没有校验和，流量类别和流标签也不属于伪首部
+		if o.ttl.random() {
+			frame[ip+7] = uint8(o.ttl.value())
+		}
+		if o.tos.random() {
+			tc := uint8(o.tos.value())
+			frame[ip] = frame[ip]&0xf0 | tc>>4
+			frame[ip+1] = tc<<4 | frame[ip+1]&0x0f
+		}
+		if o.flowLabel.random() {
+			fl := o.flowLabel.value()
+			frame[ip+1] = frame[ip+1]&0xf0 | uint8(fl>>16)&0x0f
+			frame[ip+2], frame[ip+3] = uint8(fl>>8), uint8(fl)
+		}
+	}
+	if c.summary.tcp && o.window.random() {
+		patch16(frame, c.l4Off+14, uint16(o.window.value()), c.l4Sum)
+	}
+}
+
+// checksumAdjust 按 RFC 1624 (HC' = ~(~HC + ~m + m')) 增量更新校验和，old 和 new 为被替换的16位字
+func checksumAdjust(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = (s & 0xffff) + (s >> 16)
+	s = (s & 0xffff) + (s >> 16)
+	return ^uint16(s)
+}
+
+// patchBytes 将 buf[off:] 替换为 value，并增量更新 sums 中各偏移处的校验和 (负数偏移被忽略)
+// 各校验范围须从偶数偏移开始，以便按帧内偏移对齐16位字
+func patchBytes(buf []byte, off int, value []byte, sums ...int) {
+	end := off + len(value)
+	for w := off &^ 1; w < end; w += 2 {
+		old := binary.BigEndian.Uint16(buf[w:])
+		for i := w; i < w+2; i++ {
+			if i >= off && i < end {
+				buf[i] = value[i-off]
+			}
+		}
+		new := binary.BigEndian.Uint16(buf[w:])
+		for _, sum := range sums {
+			if sum >= 0 {
+				binary.BigEndian.PutUint16(buf[sum:], checksumAdjust(binary.BigEndian.Uint16(buf[sum:]), old, new))
+			}
+		}
+	}
+}
+
+// patch8 修补一个字节并增量更新校验和
+func patch8(buf []byte, off int, v uint8, sums ...int) {
+	b := [1]byte{v}
+	patchBytes(buf, off, b[:], sums...)
+}
+
+// patch16 修补一个16位字段并增量更新校验和
+func patch16(buf []byte, off int, v uint16, sums ...int) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	patchBytes(buf, off, b[:], sums...)
+}
+
+// patch32 修补一个32位字段并增量更新校验和
+func patch32(buf []byte, off int, v uint32, sums ...int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	patchBytes(buf, off, b[:], sums...)
+}
@@ -0,0 +1,277 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testSrcMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	testDstMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+)
+
+// testTemplate 序列化给定的层 (以太网层之后) 并解码为模板
+func testTemplate(t *testing.T, ip gopacket.NetworkLayer, stack ...gopacket.SerializableLayer) PacketTemplate {
+	t.Helper()
+	eth := &layers.Ethernet{SrcMAC: testSrcMAC, DstMAC: testDstMAC, EthernetType: layers.EthernetTypeIPv4}
+	if _, ok := ip.(*layers.IPv6); ok {
+		eth.EthernetType = layers.EthernetTypeIPv6
+	}
+	for _, l := range stack {
+		if c, ok := l.(checksumLayer); ok {
+			c.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	all := append([]gopacket.SerializableLayer{eth, ip.(gopacket.SerializableLayer)}, stack...)
+	if err := gopacket.SerializeLayers(buffer, options, all...); err != nil {
+		t.Fatalf("序列化模板失败: %v", err)
+	}
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	return PacketTemplate{Packet: packet, Index: 1, LinkType: layers.LinkTypeEthernet, Source: "test"}
+}
+
+func testIPv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, TOS: 0x10, Id: 0x1234, Protocol: proto,
+		SrcIP: net.IP{192, 0, 2, 1}, DstIP: net.IP{192, 0, 2, 2}}
+}
+
+func testIPv6(next layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, TrafficClass: 0x20, FlowLabel: 0x12345, NextHeader: next,
+		SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+}
+
+func testTCP(ack bool) *layers.TCP {
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 0x11111111, Window: 64240, SYN: !ack, ACK: ack, PSH: ack,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		}}
+	if ack {
+		tcp.Ack = 0x22222222
+		tcp.Options = append(tcp.Options,
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop},
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop},
+			layers.TCPOption{OptionType: layers.TCPOptionKindSACK, OptionLength: 10, OptionData: []byte{0x22, 0x22, 0x23, 0x22, 0x22, 0x22, 0x24, 0x22}})
+	}
+	return tcp
+}
+
+func testDNS() *layers.DNS {
+	return &layers.DNS{ID: 0xbeef, RD: true, QDCount: 1,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+}
+
+func testSCTPInit() []gopacket.SerializableLayer {
+	return []gopacket.SerializableLayer{
+		&layers.SCTP{SrcPort: 5000, DstPort: 38412, VerificationTag: 0xdeadbeef},
+		&layers.SCTPInit{SCTPChunk: layers.SCTPChunk{Type: layers.SCTPChunkTypeInit}, InitiateTag: 0x01020304,
+			AdvertisedReceiverWindowCredit: 65535, OutboundStreams: 10, InboundStreams: 10, InitialTSN: 1},
+	}
+}
+
+// frameOverrides 从修补后的帧中读取随机覆盖字段的实际取值，转换为等价的固定覆盖值
+func frameOverrides(t *testing.T, frame []byte, o *headerOverrides) *headerOverrides {
+	t.Helper()
+	if o == nil {
+		return nil
+	}
+	fixed := *o
+	pin := func(f *fieldOverride, v uint32) {
+		if f.random() {
+			*f = fieldOverride{set: true, min: v, max: v}
+		}
+	}
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	if ip4, ok := packet.NetworkLayer().(*layers.IPv4); ok {
+		pin(&fixed.ttl, uint32(ip4.TTL))
+		pin(&fixed.tos, uint32(ip4.TOS))
+		df := uint32(0)
+		if ip4.Flags&layers.IPv4DontFragment != 0 {
+			df = 1
+		}
+		pin(&fixed.df, df)
+	} else if ip6, ok := packet.NetworkLayer().(*layers.IPv6); ok {
+		pin(&fixed.ttl, uint32(ip6.HopLimit))
+		pin(&fixed.tos, uint32(ip6.TrafficClass))
+		pin(&fixed.flowLabel, ip6.FlowLabel)
+	} else {
+		t.Fatalf("无法解码修补后的帧")
+	}
+	if tcp, ok := packet.TransportLayer().(*layers.TCP); ok {
+		pin(&fixed.window, uint32(tcp.Window))
+	}
+	return &fixed
+}
+
+// serializeProbe 按发送器逐个序列化的路径构造探测报文
+func serializeProbe(t *testing.T, template *PacketTemplate, srcIP, dstIP net.IP, vlanIDs []uint16, o *headerOverrides, id *probeIdentity) []byte {
+	t.Helper()
+	probe, err := extractProbeLayers(template.Packet)
+	if err != nil {
+		t.Fatalf("提取探测层失败: %v", err)
+	}
+	if err := probe.rewriteAddresses(srcIP, dstIP); err != nil {
+		t.Fatalf("替换地址失败: %v", err)
+	}
+	probe.applyOverrides(o)
+	probe.applyIdentity(id)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, probeFrameLayers(probe, template.Packet, testSrcMAC, testDstMAC, vlanIDs)...); err != nil {
+		t.Fatalf("序列化探测报文失败: %v", err)
+	}
+	return buffer.Bytes()
+}
+
+func TestCompiledTemplateMatchesSerialization(t *testing.T) {
+	udp4 := &layers.UDP{SrcPort: 53000, DstPort: 53}
+	udp6 := &layers.UDP{SrcPort: 53000, DstPort: 53}
+	templates := []struct {
+		name     string
+		template PacketTemplate
+	}{
+		{"TCP-SYN/IPv4", testTemplate(t, testIPv4(layers.IPProtocolTCP), testTCP(false))},
+		{"TCP-ACK/IPv4", testTemplate(t, testIPv4(layers.IPProtocolTCP), testTCP(true), gopacket.Payload("GET / HTTP/1.0\r\n\r\n"))},
+		{"TCP-SYN/IPv6", testTemplate(t, testIPv6(layers.IPProtocolTCP), testTCP(false))},
+		{"TCP-ACK/IPv6", testTemplate(t, testIPv6(layers.IPProtocolTCP), testTCP(true))},
+		{"DNS/IPv4", testTemplate(t, testIPv4(layers.IPProtocolUDP), udp4, testDNS())},
+		{"DNS/IPv6", testTemplate(t, testIPv6(layers.IPProtocolUDP), udp6, testDNS())},
+		{"UDP/IPv4", testTemplate(t, testIPv4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 40000, DstPort: 123}, gopacket.Payload{0x17, 0x00, 0x03, 0x2a, 0, 0, 0, 0})},
+		{"ICMPv4-Echo", testTemplate(t, testIPv4(layers.IPProtocolICMPv4),
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 0x4321, Seq: 7}, gopacket.Payload("abcdefgh"))},
+		{"ICMPv6-Echo", testTemplate(t, testIPv6(layers.IPProtocolICMPv6),
+			&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)},
+			&layers.ICMPv6Echo{Identifier: 0x4321, SeqNumber: 7}, gopacket.Payload("abcdefgh"))},
+		{"SCTP-INIT/IPv4", testTemplate(t, testIPv4(layers.IPProtocolSCTP), testSCTPInit()...)},
+		{"SCTP-INIT/IPv6", testTemplate(t, testIPv6(layers.IPProtocolSCTP), testSCTPInit()...)},
+	}
+
+	fixed, err := parseHeaderOverrides("33", "184", "true", "1024", "", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random, err := parseHeaderOverrides("random", "random", "random", "random", "", "random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides := []struct {
+		name string
+		o    *headerOverrides
+	}{{"无覆盖", nil}, {"固定覆盖", fixed}, {"随机覆盖", random}}
+	vlans := [][]uint16{nil, {100}, {100, 200}}
+
+	identities := []probeIdentity{
+		{echoID: 0x1111, echoSeq: 0x2222, tcpSeq: 0x12345678, tcpAck: 0x9abcdef0, tsval: 0x01010101, tsecr: 0xfefefefe, sctpPort: 61000, sctpTag: 0x55aa55ab, dnsID: 0x3333},
+		{echoID: 0xffff, echoSeq: 0, tcpSeq: 0xffffffff, tcpAck: 1, tsval: 0, tsecr: 0xffffffff, sctpPort: 1, sctpTag: 1, dnsID: 0},
+	}
+
+	for _, tc := range templates {
+		for _, ov := range overrides {
+			for _, vlanIDs := range vlans {
+				template := tc.template
+				ip6 := template.Packet.Layer(layers.LayerTypeIPv6) != nil
+				srcIP, dstIP := net.IP{198, 51, 100, 1}, net.IP{203, 0, 113, 77}
+				if ip6 {
+					srcIP, dstIP = net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:ffff::4d")
+				}
+				compiled := compileTemplate(&template, srcIP, testSrcMAC, vlanIDs, ov.o, "")
+				if compiled == nil {
+					t.Fatalf("%s/%s/VLAN%v: 模板无法预编译", tc.name, ov.name, vlanIDs)
+				}
+				for i := range identities {
+					id := identities[i]
+					got := compiled.build(nil, testDstMAC, dstIP, &id, ov.o)
+					want := serializeProbe(t, &template, srcIP, dstIP, vlanIDs, frameOverrides(t, got, ov.o), &id)
+					if !bytes.Equal(got, want) {
+						t.Errorf("%s/%s/VLAN%v/标识%d: 预编译的帧与完整序列化不一致\n预编译: %x\n序列化: %x", tc.name, ov.name, vlanIDs, i, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestChecksumAdjust(t *testing.T) {
+	// 修补任意16位字后的增量校验和应与重新计算的结果一致
+	data := []byte{0x45, 0x00, 0x00, 0x54, 0xab, 0xcd, 0x40, 0x00, 0x40, 0x01, 0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	full := func(b []byte) uint16 {
+		var s uint32
+		for i := 0; i+1 < len(b); i += 2 {
+			s += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		for s > 0xffff {
+			s = (s & 0xffff) + (s >> 16)
+		}
+		return ^uint16(s)
+	}
+	binary.BigEndian.PutUint16(data[10:], full(data))
+	for _, v := range []uint16{0, 1, 0x7fff, 0xfffe, 0xffff, 0xc0a8} {
+		patch16(data, 16, v, 10)
+		sum := binary.BigEndian.Uint16(data[10:])
+		binary.BigEndian.PutUint16(data[10:], 0)
+		if want := full(data); sum != want {
+			t.Errorf("修补为 %#04x 后校验和为 %#04x，期望 %#04x", v, sum, want)
+		}
+		binary.BigEndian.PutUint16(data[10:], sum)
+	}
+}
+
+func TestCompiledTemplateRejectsMismatchedTarget(t *testing.T) {
+	// IP版本与模板不一致的目标在两条路径上都应被拒绝，预编译路径不能发往 ::ffff:a.b.c.d 或 0.0.0.0
+	cases := []struct {
+		name         string
+		template     PacketTemplate
+		srcIP, dstIP net.IP
+	}{
+		{"IPv4模板/IPv6目标", testTemplate(t, testIPv4(layers.IPProtocolTCP), testTCP(false)), net.IP{198, 51, 100, 1}, net.ParseIP("2001:db8:ffff::4d")},
+		{"IPv6模板/IPv4目标", testTemplate(t, testIPv6(layers.IPProtocolTCP), testTCP(false)), net.ParseIP("2001:db8:1::1"), net.IP{203, 0, 113, 77}},
+	}
+	for _, tc := range cases {
+		compiled := compileTemplate(&tc.template, tc.srcIP, testSrcMAC, nil, nil, "")
+		if compiled == nil {
+			t.Fatalf("%s: 模板无法预编译", tc.name)
+		}
+		compiledErr := compiled.checkTarget(tc.srcIP, tc.dstIP)
+		if compiledErr == nil {
+			t.Errorf("%s: 预编译路径接受了IP版本不一致的目标", tc.name)
+		}
+		probe, err := extractProbeLayers(tc.template.Packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serializeErr := probe.rewriteAddresses(tc.srcIP, tc.dstIP)
+		if serializeErr == nil {
+			t.Errorf("%s: 序列化路径接受了IP版本不一致的目标", tc.name)
+		}
+		if compiledErr != nil && serializeErr != nil && compiledErr.Error() != serializeErr.Error() {
+			t.Errorf("%s: 两条路径的错误信息不一致: %q, %q", tc.name, compiledErr, serializeErr)
+		}
+	}
+}
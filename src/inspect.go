@@ -0,0 +1,225 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// templateInfo 描述一个模板在扫描时的处理方式，供 inspect 子命令输出
+type templateInfo struct {
+	Source        string   `json:"source"` // 模板所在的文件，pcap模板和模板规范中的模板序号都从1开始
+	Index         int      `json:"index"`
+	Label         string   `json:"label,omitempty"`
+	LinkType      string   `json:"link_type"`
+	Network       string   `json:"network"`
+	Protocol      string   `json:"protocol"`
+	SrcPort       uint16   `json:"src_port,omitempty"`
+	DstPort       uint16   `json:"dst_port,omitempty"`
+	Flags         string   `json:"flags,omitempty"`
+	PayloadLength int      `json:"payload_length"`
+	Length        int      `json:"length"`
+	Truncated     int      `json:"truncated,omitempty"`
+	Layers        []string `json:"layers"`
+	DroppedLayers []string `json:"dropped_layers,omitempty"` // 发送时被丢弃并重新构建的链路层
+	RawLayers     []string `json:"raw_layers,omitempty"`     // 无法解析字段、按原始字节发送的层
+}
+
+// inspectReport 是 inspect 子命令的完整输出
+type inspectReport struct {
+	Source    string          `json:"source"`
+	Templates []templateInfo  `json:"templates"`
+	Skipped   []SkippedPacket `json:"skipped"`
+}
+
+// runInspect 实现 inspect 子命令: 列出扫描器将从pcap文件中使用的模板及被跳过的报文
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	pcapFile := fs.String("pcap", "", "要检查的pcap或pcapng文件路径")
+	specFile := fs.String("template-spec", "", "要检查的JSON或YAML模板规范文件路径")
+	templateFilter := fs.String("template-filter", "", "用于筛选模板的BPF过滤表达式，与扫描时的同名参数相同")
+	templateIndex := fs.String("template-index", "", "要使用的模板序号，与扫描时的同名参数相同")
+	truncated := fs.String("truncated", truncatedSkip, "截断模板的处理方式，与扫描时的同名参数相同")
+	jsonOutput := fs.Bool("json", false, "以JSON格式输出")
+	fs.Parse(args)
+
+	if *pcapFile == "" && *specFile == "" {
+		fs.Usage()
+		log.Fatal("错误: 必须提供 -pcap 或 -template-spec 参数。")
+	}
+
+	templates, skipped, err := loadTemplates(*pcapFile, *specFile, *templateFilter, *templateIndex, *truncated)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	source := *pcapFile
+	if *specFile != "" {
+		source = strings.TrimPrefix(source+", "+*specFile, ", ")
+	}
+	report := inspectReport{Source: source, Templates: []templateInfo{}, Skipped: skipped}
+	if report.Skipped == nil {
+		report.Skipped = []SkippedPacket{}
+	}
+	for i := range templates {
+		report.Templates = append(report.Templates, describeTemplate(&templates[i]))
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("输出JSON时出错: %v", err)
+		}
+		return
+	}
+	printInspectReport(report)
+}
+
+// describeTemplate 分析模板在发送时的处理方式
+func describeTemplate(t *PacketTemplate) templateInfo {
+	info := templateInfo{
+		Source:    t.Source,
+		Index:     t.Index,
+		Label:     t.Label,
+		LinkType:  t.LinkType.String(),
+		Length:    len(t.Packet.Data()),
+		Truncated: t.Truncated,
+	}
+	for _, layer := range t.Packet.Layers() {
+		info.Layers = append(info.Layers, layer.LayerType().String())
+	}
+	// 传输层之后的全部字节均视为载荷 (包括无法解码的应用层数据)
+	if transport := t.Packet.TransportLayer(); transport != nil {
+		info.PayloadLength = len(transport.LayerPayload())
+	} else if app := t.Packet.ApplicationLayer(); app != nil {
+		info.PayloadLength = len(app.Payload())
+	}
+
+	probe, err := extractProbeLayers(t.Packet)
+	if err != nil {
+		return info
+	}
+	// 按发送时序列化的层计算载荷长度，包括 gopacket 未解码为应用层的ICMPv6回显数据
+	if n, ok := probe.payloadLength(); ok {
+		info.PayloadLength = n
+	}
+	info.DroppedLayers = layerTypeNames(probe.dropped)
+	info.RawLayers = layerTypeNames(probe.raw)
+	if probe.ip4 != nil {
+		info.Network = "IPv4"
+	} else {
+		info.Network = "IPv6"
+	}
+	info.Protocol = probe.protocol().String()
+
+	switch {
+	case probe.tcp != nil:
+		info.SrcPort, info.DstPort = uint16(probe.tcp.SrcPort), uint16(probe.tcp.DstPort)
+		info.Flags = tcpFlagsString(probe.tcp)
+	case probe.udp != nil:
+		info.SrcPort, info.DstPort = uint16(probe.udp.SrcPort), uint16(probe.udp.DstPort)
+	case probe.sctp != nil:
+		info.SrcPort, info.DstPort = uint16(probe.sctp.SrcPort), uint16(probe.sctp.DstPort)
+		if probe.sctpInit != nil {
+			info.Flags = "INIT"
+		}
+	default:
+		if icmp, ok := t.Packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			info.Flags = icmp.TypeCode.String()
+		} else if icmp, ok := t.Packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			info.Flags = icmp.TypeCode.String()
+		}
+	}
+	return info
+}
+
+// tcpFlagsString 返回TCP标志位的文本表示 (例如: SYN,ACK)
+func tcpFlagsString(tcp *layers.TCP) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{tcp.FIN, "FIN"}, {tcp.SYN, "SYN"}, {tcp.RST, "RST"}, {tcp.PSH, "PSH"},
+		{tcp.ACK, "ACK"}, {tcp.URG, "URG"}, {tcp.ECE, "ECE"}, {tcp.CWR, "CWR"}, {tcp.NS, "NS"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// layerTypeNames 将层类型列表转换为名称列表
+func layerTypeNames(types []gopacket.LayerType) []string {
+	var names []string
+	for _, t := range types {
+		names = append(names, t.String())
+	}
+	return names
+}
+
+// printInspectReport 以表格形式输出检查结果
+func printInspectReport(report inspectReport) {
+	fmt.Printf("文件: %s\n", report.Source)
+	fmt.Printf("可用模板: %d 个\n\n", len(report.Templates))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "来源\t序号\t标签\t链路类型\t网络层\t协议\t源端口\t目的端口\t标志\t载荷长度\t丢弃的层\t原始字节层")
+	for _, t := range report.Templates {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			t.Source, t.Index, orDash(t.Label), t.LinkType, t.Network, t.Protocol,
+			portString(t.SrcPort), portString(t.DstPort), orDash(t.Flags), t.PayloadLength,
+			orDash(strings.Join(t.DroppedLayers, ",")), orDash(strings.Join(t.RawLayers, ",")))
+	}
+	w.Flush()
+
+	if len(report.Skipped) > 0 {
+		fmt.Printf("\n跳过的报文: %d 个\n", len(report.Skipped))
+		for _, s := range report.Skipped {
+			fmt.Printf("  #%d: %s\n", s.Index, s.Reason)
+		}
+	}
+}
+
+// portString 返回端口的文本表示，0 表示无端口
+func portString(port uint16) string {
+	if port == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", port)
+}
+
+// orDash 在字符串为空时返回 "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDescribeTemplatePayloadLength(t *testing.T) {
+	cases := []struct {
+		name     string
+		template PacketTemplate
+		want     int
+	}{
+		{"TCP", testTemplate(t, testIPv4(layers.IPProtocolTCP), testTCP(true), gopacket.Payload("GET / HTTP/1.0\r\n\r\n")), 18},
+		{"TCP-SYN", testTemplate(t, testIPv4(layers.IPProtocolTCP), testTCP(false)), 0},
+		{"DNS", testTemplate(t, testIPv4(layers.IPProtocolUDP), &layers.UDP{SrcPort: 53000, DstPort: 53}, testDNS()), 29},
+		{"ICMPv4-Echo", testTemplate(t, testIPv4(layers.IPProtocolICMPv4),
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}, gopacket.Payload("abcdefgh")), 8},
+		// gopacket 不将ICMPv6回显数据解码为应用层
+		{"ICMPv6-Echo", testTemplate(t, testIPv6(layers.IPProtocolICMPv6),
+			&layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)},
+			&layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1}, gopacket.Payload("abcdefghijkl")), 12},
+	}
+	for _, tc := range cases {
+		if got := describeTemplate(&tc.template).PayloadLength; got != tc.want {
+			t.Errorf("%s: 载荷长度为 %d，期望 %d", tc.name, got, tc.want)
+		}
+	}
+}
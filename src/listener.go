@@ -19,36 +19,44 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
 )
 
-// listenForResponses 监听传入报文并保存匹配的响应
-func listenForResponses(wg *sync.WaitGroup, ifaceName string, srcIP net.IP, sentSessions map[SessionKey]struct{}, mu *sync.Mutex, senderDone chan struct{}) {
+// listenForResponses 在每个捕获接口上监听传入报文，将匹配的响应保存到同一个pcap文件
+func listenForResponses(wg *sync.WaitGroup, captureIfaces []string, captureFilter string, sessions *sessionTable, senderDone chan struct{}, vlanDepth int, results *scanResults, stats *captureStats, rxBackend string) {
 	defer wg.Done()
 
-	// 打开网络接口进行捕获
-	handle, err := pcap.OpenLive(ifaceName, 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("打开接口 %s 进行捕获时出错: %v", ifaceName, err)
+	// 打开网络接口进行捕获，应用根据探测计划生成的BPF过滤器 (包括带VLAN标签的响应)
+	filter := vlanAwareFilter(captureFilter, vlanDepth)
+	sources := make([]captureSource, len(captureIfaces))
+	for i, ifaceName := range captureIfaces {
+		source, backend, err := openCaptureSource(rxBackend, ifaceName, filter, vlanDepth)
+		if err != nil {
+			log.Fatalf("打开接口 %s 进行捕获时出错: %v", ifaceName, err)
+		}
+		defer source.Close()
+		sources[i] = source
+		log.Printf("正在 %s 上监听响应 (接收后端: %s)，过滤器: %s", ifaceName, backend, filter)
 	}
-	defer handle.Close()
 
-	// 应用BPF过滤器，只捕获发往我们源IP的流量
-	filter := fmt.Sprintf("dst host %s", srcIP.String())
-	if err := handle.SetBPFFilter(filter); err != nil {
-		log.Fatalf("设置BPF过滤器时出错: %v", err)
+	// 全部接口的响应写入同一个pcap文件，因此链路类型必须相同
+	linkType := sources[0].LinkType()
+	for i, source := range sources[1:] {
+		if source.LinkType() != linkType {
+			log.Fatalf("错误: 捕获接口 %s 的链路类型 %s 与 %s 的链路类型 %s 不同，无法写入同一个pcap文件。", captureIfaces[i+1], source.LinkType(), captureIfaces[0], linkType)
+		}
 	}
-	log.Printf("正在 %s 上监听响应，过滤器: %s", ifaceName, filter)
 
 	// 为响应创建pcap写入器
 	timestamp := time.Now().Format("2006-01-02_15-04-05")
@@ -59,79 +67,576 @@ func listenForResponses(wg *sync.WaitGroup, ifaceName string, srcIP net.IP, sent
 	}
 	defer f.Close()
 	w := pcapgo.NewWriter(f)
-	if err := w.WriteFileHeader(uint32(1600), handle.LinkType()); err != nil {
+	if err := w.WriteFileHeader(uint32(captureSnaplen), linkType); err != nil {
 		log.Fatalf("写入pcap文件头时出错: %v", err)
 	}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	m := &responseMatcher{
+		sessions:       sessions,
+		results:        results,
+		stats:          stats,
+		outputPcapFile: outputPcapFile,
+		writer:         w,
+		udpFragments:   newFragmentTable(sessions.ttl),
+		drops:          make([]atomic.Uint64, len(sources)),
+	}
+	// 每个捕获接口使用独立的协程和解码器
+	var captureWG sync.WaitGroup
+	for i, source := range sources {
+		dec, err := newResponseDecoder(linkType)
+		if err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+		captureWG.Add(1)
+		go m.capture(&captureWG, i, captureIfaces[i], source, dec, senderDone)
+	}
+	captureWG.Wait()
+	log.Println("监听器正在关闭。")
+}
+
+// responseMatcher 将各捕获接口上收到的报文与会话表匹配，并把匹配的响应写入同一个pcap文件
+type responseMatcher struct {
+	sessions       *sessionTable
+	results        *scanResults
+	stats          *captureStats
+	outputPcapFile string
+	drops          []atomic.Uint64 // 每个捕获接口的内核和网卡丢包数
+
+	mu     sync.Mutex // 保护 writer 和 udpFragments
+	writer *pcapgo.Writer
+	// 已匹配的UDP响应首个分片，用于关联不含UDP头的后续分片
+	udpFragments *fragmentTable
+}
+
+// capture 循环读取一个捕获接口上的报文，直到发送器完成后再等待一个响应窗口
+func (m *responseMatcher) capture(wg *sync.WaitGroup, index int, ifaceName string, source captureSource, dec *responseDecoder, senderDone chan struct{}) {
+	defer wg.Done()
+
+	// 定期读取捕获端的丢包统计供自适应速率控制使用，并轮换分片记录表
+	statsTicker := time.NewTicker(adaptiveInterval)
+	defer statsTicker.Stop()
+	var undecodable uint64 // 已读取但无法解码为可识别响应的报文数 (不属于丢包)
+	var deadline time.Time
 
-	// 循环捕获报文
 	for {
 		select {
-		case packet := <-packetSource.Packets():
-			// 解析传入报文
-			var ip4Layer *layers.IPv4
-			var ip6Layer *layers.IPv6
-			var tcpLayer *layers.TCP
-			var udpLayer *layers.UDP
-
-			for _, layer := range packet.Layers() {
-				switch layerType := layer.LayerType(); layerType {
-				case layers.LayerTypeIPv4:
-					ip4Layer = layer.(*layers.IPv4)
-				case layers.LayerTypeIPv6:
-					ip6Layer = layer.(*layers.IPv6)
-				case layers.LayerTypeTCP:
-					tcpLayer = layer.(*layers.TCP)
-				case layers.LayerTypeUDP:
-					udpLayer = layer.(*layers.UDP)
+		case <-statsTicker.C:
+			if queue, iface, err := source.Drops(); err == nil {
+				m.updateDrops(index, queue+iface)
+			}
+			m.expireFragments()
+		case <-senderDone:
+			if index == 0 {
+				log.Println("发送器完成。等待最终响应...")
+			}
+			deadline = time.Now().Add(m.sessions.ttl) // 等待一个响应窗口，留出时间给最后的响应
+			senderDone = nil
+		default:
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+
+		data, ci, err := source.ZeroCopyReadPacketData()
+		if err == errCaptureTimeout {
+			continue
+		}
+		if err != nil {
+			log.Printf("在 %s 上捕获报文时出错: %v，停止在该接口上捕获。", ifaceName, err)
+			break
+		}
+
+		// 解析传入报文，层对象是预分配的，只在处理本报文期间有效
+		if !dec.decode(data) {
+			undecodable++
+			continue
+		}
+		m.match(dec, ci, data)
+	}
+
+	if queue, iface, err := source.Drops(); err == nil {
+		log.Printf("%s 捕获统计: 捕获缓冲区已满 (用户空间读取跟不上) 丢弃 %d 个报文，网卡丢弃 %d 个报文；另有 %d 个已接收的报文无法解码。", ifaceName, queue, iface, undecodable)
+	} else {
+		log.Printf("%s 捕获统计: 无法读取丢包计数 (%v)；%d 个已接收的报文无法解码。", ifaceName, err, undecodable)
+	}
+}
+
+// updateDrops 记录一个捕获接口的丢包数，并向自适应速率控制报告全部接口的丢包总数
+func (m *responseMatcher) updateDrops(index int, dropped uint64) {
+	m.drops[index].Store(dropped)
+	var total uint64
+	for i := range m.drops {
+		total += m.drops[i].Load()
+	}
+	m.stats.dropped.Store(total)
+}
+
+// match 检查解码后的报文是否是我们发送的探测报文的响应，记录结果并保存匹配的报文
+func (m *responseMatcher) match(dec *responseDecoder, ci gopacket.CaptureInfo, data []byte) {
+	ip4Layer, ip6Layer, frag6Layer := dec.ip4Layer, dec.ip6Layer, dec.frag6Layer
+	tcpLayer, udpLayer, sctpLayer, dnsLayer := dec.tcpLayer, dec.udpLayer, dec.sctpLayer, dec.dnsLayer
+	icmp4Layer, icmp6Layer, echo6Layer := dec.icmp4Layer, dec.icmp6Layer, dec.echo6Layer
+	var sctpState string
+	sctpTagReflected := false // ABORT的T标志位表示验证标签是从INIT报文中反射的
+	if sctpLayer != nil {
+		sctpState, sctpTagReflected = sctpResponseState(sctpLayer.Payload)
+	}
+
+	// 构造反向会话键
+	var incomingKey SessionKey
+	if ip4Layer != nil {
+		incomingKey.SrcIP = addrFromIP(ip4Layer.DstIP) // 我们发送的目标IP现在是它们的源IP
+		incomingKey.DstIP = addrFromIP(ip4Layer.SrcIP) // 我们发送的源IP现在是它们的目标IP
+		incomingKey.Proto = ip4Layer.Protocol
+	} else {
+		incomingKey.SrcIP = addrFromIP(ip6Layer.DstIP)
+		incomingKey.DstIP = addrFromIP(ip6Layer.SrcIP)
+		incomingKey.Proto = ip6Layer.NextHeader
+	}
+
+	// ICMP差错报文 (端口不可达、超时等) 引用了触发它的探测报文头，按引用的报文匹配会话
+	if key, ok := icmpErrorKey(icmp4Layer, icmp6Layer); ok {
+		if _, found := m.sessions.lookup(key); found {
+			log.Printf("匹配到来自 %s 的ICMP差错报文，对应发往 %s 的探测。保存到 %s", incomingKey.DstIP, key.DstIP, m.outputPcapFile)
+			m.save(ci, data)
+		}
+		return
+	}
+
+	// 较大的UDP响应 (如DNS、memcached、CLDAP) 会被IP分片，分片中的UDP层不会被解码
+	// 首个分片按其中的UDP头匹配会话，后续分片不含UDP头，按分片标识关联到首个分片
+	frag, isFragment := udpFragmentOf(ip4Layer, ip6Layer, frag6Layer)
+	if isFragment && !frag.first {
+		if owner, ok := m.fragment(frag.id); ok {
+			m.results.recordUDPResponse(owner.key.DstIP.String(), owner.template, ipLength(ip4Layer, ip6Layer))
+			m.save(ci, data)
+		}
+		return
+	}
+
+	// 回显应答携带与请求相同的标识符和序列号
+	isEchoReply := false
+	if icmp4Layer != nil && icmp4Layer.TypeCode.Type() == layers.ICMPv4TypeEchoReply {
+		incomingKey.SrcPort = icmp4Layer.Id
+		incomingKey.DstPort = icmp4Layer.Seq
+		incomingKey.Proto = layers.IPProtocolICMPv4
+		isEchoReply = true
+	} else if icmp6Layer != nil && echo6Layer != nil && icmp6Layer.TypeCode.Type() == layers.ICMPv6TypeEchoReply {
+		incomingKey.SrcPort = echo6Layer.Identifier
+		incomingKey.DstPort = echo6Layer.SeqNumber
+		incomingKey.Proto = layers.IPProtocolICMPv6
+		isEchoReply = true
+	} else if sctpLayer != nil {
+		incomingKey.SrcPort = uint16(sctpLayer.DstPort)
+		incomingKey.DstPort = uint16(sctpLayer.SrcPort)
+	} else if tcpLayer != nil {
+		incomingKey.SrcPort = uint16(tcpLayer.DstPort) // 我们发送的目标端口现在是它们的源端口
+		incomingKey.DstPort = uint16(tcpLayer.SrcPort) // 我们发送的源端口现在是它们的目标端口
+	} else if udpLayer != nil {
+		incomingKey.SrcPort = uint16(udpLayer.DstPort)
+		incomingKey.DstPort = uint16(udpLayer.SrcPort)
+	} else if isFragment {
+		incomingKey.SrcPort = binary.BigEndian.Uint16(frag.data[2:4])
+		incomingKey.DstPort = binary.BigEndian.Uint16(frag.data[0:2])
+		incomingKey.Proto = layers.IPProtocolUDP
+	}
+
+	// 分片中的DNS层不会被解码，从首个分片的UDP载荷中读取DNS报文头
+	if isFragment {
+		dnsLayer = dnsHeader(frag.data[8:])
+	}
+
+	// 检查这是否是我们发送的报文的响应
+	// 共用端口的多个模板 (如同一连接中的SYN和ACK) 会以同一会话键连续发送，响应与其中任意一次发送匹配即可
+	info, found := m.sessions.lookup(incomingKey)
+	if found {
+		info, found = info.match(func(attempt *SessionInfo) bool {
+			// SCTP响应的验证标签必须等于INIT中的发起标签，或为反射自INIT的0
+			if sctpLayer != nil && attempt.SCTPTag != 0 {
+				expected := attempt.SCTPTag
+				if sctpTagReflected {
+					expected = 0
+				}
+				if sctpLayer.VerificationTag != expected {
+					return false
 				}
 			}
 
-			// 构造反向会话键
-			var incomingKey SessionKey
-			if ip4Layer != nil {
-				incomingKey.SrcIP = ip4Layer.DstIP.String() // 我们发送的目标IP现在是它们的源IP
-				incomingKey.DstIP = ip4Layer.SrcIP.String() // 我们发送的源IP现在是它们的目标IP
-				incomingKey.Proto = ip4Layer.Protocol
-			} else if ip6Layer != nil {
-				incomingKey.SrcIP = ip6Layer.DstIP.String()
-				incomingKey.DstIP = ip6Layer.SrcIP.String()
-				incomingKey.Proto = ip6Layer.NextHeader
-			} else {
-				continue // 不是IP报文，忽略
+			// TCP响应置位ACK时确认号必须落在探测报文的序列号空间内 (对端可能只确认SYN而不确认其携带的数据)
+			// 不带ACK的RST的序列号必须等于探测报文的确认号 (RFC 793)
+			if tcpLayer != nil && incomingKey.Proto == layers.IPProtocolTCP {
+				if tcpLayer.ACK {
+					return tcpLayer.Ack-attempt.TCPSeq <= attempt.TCPLen
+				} else if tcpLayer.RST && attempt.TCPAckSet {
+					return tcpLayer.Seq == attempt.TCPAck
+				}
 			}
 
-			if tcpLayer != nil {
-				incomingKey.SrcPort = uint16(tcpLayer.DstPort) // 我们发送的目标端口现在是它们的源端口
-				incomingKey.DstPort = uint16(tcpLayer.SrcPort) // 我们发送的源端口现在是它们的目标端口
-			} else if udpLayer != nil {
-				incomingKey.SrcPort = uint16(udpLayer.DstPort)
-				incomingKey.DstPort = uint16(udpLayer.SrcPort)
+			// DNS响应的事务ID必须与对应查询的ID相同
+			if attempt.DNSQuery && (udpLayer != nil || isFragment) {
+				return dnsLayer != nil && dnsLayer.QR && dnsLayer.ID == attempt.DNSID
 			}
+			return true
+		})
+	}
 
-			// 检查这是否是我们发送的报文的响应
-			mu.Lock()
-			_, found := sentSessions[incomingKey]
-			mu.Unlock()
+	if found {
+		m.stats.responses.Add(1)
+		target := incomingKey.DstIP.String()
+		if isEchoReply {
+			m.results.recordEchoReply(target, ci.Timestamp.Sub(info.SentAt))
+		}
+		if sctpLayer != nil && sctpState != "" {
+			m.results.recordSCTPResponse(target, incomingKey.DstPort, sctpState)
+		}
+		if info.DNSQuery && dnsLayer != nil {
+			m.results.recordDNSResponse(target, incomingKey.DstPort, dnsLayer)
+		}
+		if incomingKey.Proto == layers.IPProtocolUDP {
+			m.results.recordUDPResponse(target, info.Template, ipLength(ip4Layer, ip6Layer))
+			if isFragment {
+				m.rememberFragment(frag.id, fragmentOwner{key: incomingKey, template: info.Template})
+			}
+		}
+		log.Printf("匹配到来自 %s 到 %s 的响应。保存到 %s", incomingKey.DstIP, incomingKey.SrcIP, m.outputPcapFile)
+		m.save(ci, data)
+	}
+}
 
-			if found {
-				log.Printf("匹配到来自 %s 到 %s 的响应。保存到 %s", incomingKey.DstIP, incomingKey.SrcIP, outputPcapFile)
-				if err := w.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
-					log.Printf("写入pcap文件时出错: %v", err)
-				}
-				// 可选: 从map中删除以避免同一会话的重复匹配
-				// mu.Lock()
-				// delete(sentSessions, incomingKey)
-				// mu.Unlock()
+// save 将匹配的报文写入pcap文件
+func (m *responseMatcher) save(ci gopacket.CaptureInfo, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.writer.WritePacket(ci, data); err != nil {
+		log.Printf("写入pcap文件时出错: %v", err)
+	}
+}
+
+// fragment 返回已匹配的首个分片所属的会话
+func (m *responseMatcher) fragment(id string) (fragmentOwner, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.udpFragments.get(id, time.Now())
+}
+
+// rememberFragment 记录已匹配的首个分片所属的会话，供关联后续分片
+func (m *responseMatcher) rememberFragment(id string, owner fragmentOwner) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.udpFragments.put(id, owner, time.Now())
+}
+
+// expireFragments 轮换分片记录表，使没有新分片到达时过期的记录也能被释放
+func (m *responseMatcher) expireFragments() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.udpFragments.rotate(time.Now())
+}
+
+// fragmentOwner 是已匹配的首个分片所属的会话及其探测报文所用的模板
+type fragmentOwner struct {
+	key      SessionKey
+	template templateRef
+}
+
+// fragmentTable 记录已匹配的UDP响应首个分片: 分片标识 -> 所属会话
+// 与会话表相同，保存当前和上一代两个map，每经过一个响应窗口轮换一次，
+// 记录在一至两个响应窗口后过期，内存占用不随扫描时长增长
+type fragmentTable struct {
+	ttl      time.Duration
+	current  map[string]fragmentOwner
+	previous map[string]fragmentOwner
+	rotated  time.Time // current 开始使用的时间
+}
+
+// newFragmentTable 创建分片记录表，记录在 ttl 之后过期
+func newFragmentTable(ttl time.Duration) *fragmentTable {
+	return &fragmentTable{ttl: ttl, current: make(map[string]fragmentOwner), rotated: time.Now()}
+}
+
+// rotate 在当前一代使用超过一个响应窗口时轮换
+func (t *fragmentTable) rotate(now time.Time) {
+	if now.Sub(t.rotated) < t.ttl {
+		return
+	}
+	if now.Sub(t.rotated) >= 2*t.ttl {
+		t.previous = nil
+	} else {
+		t.previous = t.current
+	}
+	t.current = make(map[string]fragmentOwner)
+	t.rotated = now
+}
+
+// get 查找未过期的分片记录
+func (t *fragmentTable) get(id string, now time.Time) (fragmentOwner, bool) {
+	t.rotate(now)
+	owner, ok := t.current[id]
+	if !ok {
+		owner, ok = t.previous[id]
+	}
+	return owner, ok
+}
+
+// put 记录首个分片所属的会话
+func (t *fragmentTable) put(id string, owner fragmentOwner, now time.Time) {
+	t.rotate(now)
+	t.current[id] = owner
+}
+
+// ipFragment 描述一个承载UDP的IP分片
+type ipFragment struct {
+	id    string // 源地址和分片标识
+	first bool   // 是否为首个分片 (偏移为0)，首个分片以UDP头开始
+	data  []byte // 分片载荷
+}
+
+// udpFragmentOf 判断报文是否为承载UDP的IPv4或IPv6分片
+func udpFragmentOf(ip4 *layers.IPv4, ip6 *layers.IPv6, frag6 *layers.IPv6Fragment) (ipFragment, bool) {
+	var frag ipFragment
+	if ip4 != nil {
+		if ip4.Protocol != layers.IPProtocolUDP || (ip4.Flags&layers.IPv4MoreFragments == 0 && ip4.FragOffset == 0) {
+			return frag, false
+		}
+		frag = ipFragment{id: fmt.Sprintf("%s/%d", ip4.SrcIP, ip4.Id), first: ip4.FragOffset == 0, data: ip4.Payload}
+	} else if ip6 != nil && frag6 != nil {
+		if frag6.NextHeader != layers.IPProtocolUDP {
+			return frag, false
+		}
+		frag = ipFragment{id: fmt.Sprintf("%s/%d", ip6.SrcIP, frag6.Identification), first: frag6.FragmentOffset == 0, data: frag6.Payload}
+	} else {
+		return frag, false
+	}
+	// 首个分片至少要包含完整的UDP头
+	if frag.first && len(frag.data) < 8 {
+		return frag, false
+	}
+	return frag, true
+}
+
+// icmpErrorKey 从ICMP差错报文引用的原始报文头中构造探测报文的会话键
+// 引用的是我们发送的探测报文，因此其地址和端口与登记会话时的方向相同
+func icmpErrorKey(icmp4 *layers.ICMPv4, icmp6 *layers.ICMPv6) (SessionKey, bool) {
+	var key SessionKey
+	var transport []byte
+	var echoRequest uint8
+	switch {
+	case icmp4 != nil:
+		switch icmp4.TypeCode.Type() {
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+		default:
+			return key, false
+		}
+		quoted := icmp4.Payload
+		if len(quoted) < 20 || quoted[0]>>4 != 4 {
+			return key, false
+		}
+		headerLen := int(quoted[0]&0x0f) * 4
+		if headerLen < 20 || len(quoted) < headerLen {
+			return key, false
+		}
+		key.SrcIP = netip.AddrFrom4([4]byte(quoted[12:16]))
+		key.DstIP = netip.AddrFrom4([4]byte(quoted[16:20]))
+		key.Proto = layers.IPProtocol(quoted[9])
+		transport, echoRequest = quoted[headerLen:], layers.ICMPv4TypeEchoRequest
+	case icmp6 != nil:
+		switch icmp6.TypeCode.Type() {
+		case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig, layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+		default:
+			return key, false
+		}
+		// ICMPv6差错报文在引用的报文之前有4字节的MTU或指针字段
+		if len(icmp6.Payload) < 4+40 || icmp6.Payload[4]>>4 != 6 {
+			return key, false
+		}
+		quoted := icmp6.Payload[4:]
+		key.SrcIP = netip.AddrFrom16([16]byte(quoted[8:24]))
+		key.DstIP = netip.AddrFrom16([16]byte(quoted[24:40]))
+		key.Proto = layers.IPProtocol(quoted[6])
+		transport, echoRequest = quoted[40:], layers.ICMPv6TypeEchoRequest
+	default:
+		return key, false
+	}
+
+	// 差错报文至少引用传输层的前8个字节，其中包含端口或回显标识符和序列号
+	if len(transport) < 8 {
+		return key, false
+	}
+	switch key.Proto {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP:
+		key.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		key.DstPort = binary.BigEndian.Uint16(transport[2:4])
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		if transport[0] != echoRequest {
+			return key, false
+		}
+		key.SrcPort = binary.BigEndian.Uint16(transport[4:6])
+		key.DstPort = binary.BigEndian.Uint16(transport[6:8])
+	}
+	return key, true
+}
+
+// ipLength 返回IP头中记录的报文总长度 (捕获的数据可能被截断)
+func ipLength(ip4 *layers.IPv4, ip6 *layers.IPv6) int {
+	if ip4 != nil {
+		return int(ip4.Length)
+	}
+	return 40 + int(ip6.Length)
+}
+
+// dnsHeader 从分片的UDP载荷中解析DNS报文头，用于匹配无法完整解码的分片DNS响应
+func dnsHeader(data []byte) *layers.DNS {
+	if len(data) < 12 {
+		return nil
+	}
+	return &layers.DNS{
+		ID:           binary.BigEndian.Uint16(data[0:2]),
+		QR:           data[2]&0x80 != 0,
+		RD:           data[2]&0x01 != 0,
+		RA:           data[3]&0x80 != 0,
+		ResponseCode: layers.DNSResponseCode(data[3] & 0x0f),
+		QDCount:      binary.BigEndian.Uint16(data[4:6]),
+		ANCount:      binary.BigEndian.Uint16(data[6:8]),
+	}
+}
+
+// responseDecoder 使用预分配的层对象解码响应报文，解码每个报文都不分配内存
+// 解码后未出现在报文中的层为nil，层对象引用报文数据，只在下一次解码之前有效
+type responseDecoder struct {
+	parser  *gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+
+	eth      layers.Ethernet
+	sll      layers.LinuxSLL
+	loopback layers.Loopback
+	dot1q    layers.Dot1Q
+	ip4      layers.IPv4
+	ip6      layers.IPv6
+	frag6    layers.IPv6Fragment
+	fragment gopacket.Fragment
+	tcp      layers.TCP
+	udp      layers.UDP
+	icmp4    layers.ICMPv4
+	icmp6    layers.ICMPv6
+	echo6    layers.ICMPv6Echo
+	sctp     layers.SCTP
+	dns      layers.DNS
+	payload  gopacket.Payload
+
+	ip4Layer   *layers.IPv4
+	ip6Layer   *layers.IPv6
+	frag6Layer *layers.IPv6Fragment
+	tcpLayer   *layers.TCP
+	udpLayer   *layers.UDP
+	icmp4Layer *layers.ICMPv4
+	icmp6Layer *layers.ICMPv6
+	echo6Layer *layers.ICMPv6Echo
+	sctpLayer  *layers.SCTP
+	dnsLayer   *layers.DNS
+}
+
+// newResponseDecoder 为指定链路类型的捕获创建解码器
+func newResponseDecoder(linkType layers.LinkType) (*responseDecoder, error) {
+	d := &responseDecoder{}
+	var first gopacket.LayerType
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		first = layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		first = layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		first = layers.LayerTypeLoopback
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4:
+		first = layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		first = layers.LayerTypeIPv6
+	default:
+		return nil, fmt.Errorf("不支持的捕获链路类型: %s", linkType)
+	}
+	d.parser = gopacket.NewDecodingLayerParser(first,
+		&d.eth, &d.sll, &d.loopback, &d.dot1q, &d.ip4, &d.ip6, &d.fragment,
+		&d.tcp, &d.udp, &d.icmp4, &d.icmp6, &d.echo6, &d.sctp, &d.dns, &d.payload)
+	// IPv6扩展头等不支持的层只结束解码，已解码的层仍然有效
+	d.parser.IgnoreUnsupported = true
+	d.decoded = make([]gopacket.LayerType, 0, 16)
+	return d, nil
+}
+
+// decode 解码一个报文，报文不含IP层时返回false
+// 上层协议解码失败 (例如53端口上不是DNS的载荷) 不影响已解码的层
+func (d *responseDecoder) decode(data []byte) bool {
+	d.ip4Layer, d.ip6Layer, d.frag6Layer = nil, nil, nil
+	d.tcpLayer, d.udpLayer, d.sctpLayer, d.dnsLayer = nil, nil, nil, nil
+	d.icmp4Layer, d.icmp6Layer, d.echo6Layer = nil, nil, nil
+
+	d.parser.DecodeLayers(data, &d.decoded)
+	for _, layerType := range d.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			d.ip4Layer = &d.ip4
+		case layers.LayerTypeIPv6:
+			d.ip6Layer = &d.ip6
+			// gopacket没有为IPv6分片扩展头提供 DecodingLayer 实现，这里手动解析
+			if d.ip6.NextHeader == layers.IPProtocolIPv6Fragment && decodeIPv6Fragment(d.ip6.Payload, &d.frag6) {
+				d.frag6Layer = &d.frag6
 			}
+		case layers.LayerTypeTCP:
+			d.tcpLayer = &d.tcp
+		case layers.LayerTypeUDP:
+			d.udpLayer = &d.udp
+		case layers.LayerTypeICMPv4:
+			d.icmp4Layer = &d.icmp4
+		case layers.LayerTypeICMPv6:
+			d.icmp6Layer = &d.icmp6
+		case layers.LayerTypeICMPv6Echo:
+			d.echo6Layer = &d.echo6
+		case layers.LayerTypeSCTP:
+			d.sctpLayer = &d.sctp
+		case layers.LayerTypeDNS:
+			d.dnsLayer = &d.dns
+		}
+	}
+	return d.ip4Layer != nil || d.ip6Layer != nil
+}
 
-		case <-senderDone:
-			// 发送器已完成，等待一些延迟的响应，然后退出
-			log.Println("发送器完成。等待最终响应...")
-			time.Sleep(5 * time.Second) // 留出一些时间给最后的响应
-			log.Println("监听器正在关闭。")
-			return
+// decodeIPv6Fragment 解析IPv6分片扩展头
+func decodeIPv6Fragment(data []byte, frag *layers.IPv6Fragment) bool {
+	if len(data) < 8 {
+		return false
+	}
+	frag.NextHeader = layers.IPProtocol(data[0])
+	frag.Reserved1 = data[1]
+	frag.FragmentOffset = binary.BigEndian.Uint16(data[2:4]) >> 3
+	frag.Reserved2 = (data[3] >> 1) & 0x3
+	frag.MoreFragments = data[3]&0x1 != 0
+	frag.Identification = binary.BigEndian.Uint32(data[4:8])
+	frag.Contents, frag.Payload = data[:8], data[8:]
+	return true
+}
+
+// sctpResponseState 按SCTP报文中的数据块判断端口状态: INIT-ACK表示开放，ABORT表示关闭
+// reflected 返回ABORT的T标志位，表示验证标签是从INIT报文中反射的
+func sctpResponseState(chunks []byte) (state string, reflected bool) {
+	for len(chunks) >= 4 {
+		chunkType, flags := layers.SCTPChunkType(chunks[0]), chunks[1]
+		length := int(binary.BigEndian.Uint16(chunks[2:4]))
+		if length < 4 {
+			break
+		}
+		switch chunkType {
+		case layers.SCTPChunkTypeInitAck:
+			return sctpPortOpen, false
+		case layers.SCTPChunkTypeAbort:
+			if state == "" {
+				state, reflected = sctpPortClosed, flags&0x01 != 0
+			}
+		}
+		// 数据块按4字节对齐
+		length = (length + 3) &^ 3
+		if length > len(chunks) {
+			break
 		}
+		chunks = chunks[length:]
 	}
+	return state, reflected
 }
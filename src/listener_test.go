@@ -0,0 +1,285 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// newTestMatcher 创建不写入文件的响应匹配器
+func newTestMatcher(t *testing.T) (*responseMatcher, *responseDecoder) {
+	t.Helper()
+	dec, err := newResponseDecoder(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &responseMatcher{
+		sessions:     newSessionTable(time.Minute),
+		results:      newScanResults(),
+		stats:        &captureStats{},
+		writer:       pcapgo.NewWriter(io.Discard),
+		udpFragments: newFragmentTable(time.Minute),
+		drops:        make([]atomic.Uint64, 1),
+	}
+	return m, dec
+}
+
+// deliver 将响应报文交给匹配器，返回是否被接受为响应
+func deliver(t *testing.T, m *responseMatcher, dec *responseDecoder, frame []byte) bool {
+	t.Helper()
+	if !dec.decode(frame) {
+		t.Fatalf("无法解码响应报文")
+	}
+	before := m.stats.responses.Load()
+	m.match(dec, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}, frame)
+	return m.stats.responses.Load() > before
+}
+
+// testReply 构造从目标 192.0.2.2 发往扫描器 192.0.2.1 的响应帧
+func testReply(t *testing.T, proto layers.IPProtocol, stack ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	ip := testIPv4(proto)
+	ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+	template := testTemplate(t, ip, stack...)
+	return template.Packet.Data()
+}
+
+func TestMatchAcceptsAnyTCPAttemptOnSharedKey(t *testing.T) {
+	m, dec := newTestMatcher(t)
+	scanner, target := addrFromIP(net.IP{192, 0, 2, 1}), addrFromIP(net.IP{192, 0, 2, 2})
+
+	// 同一连接中的SYN和ACK两个模板共用端口，连续发送
+	tcpKey := SessionKey{SrcIP: scanner, DstIP: target, Proto: layers.IPProtocolTCP, SrcPort: 40000, DstPort: 443}
+	m.sessions.store(tcpKey, SessionInfo{SentAt: time.Now(), TCPSeq: 1000, TCPLen: 1})
+	m.sessions.store(tcpKey, SessionInfo{SentAt: time.Now(), TCPSeq: 5000, TCPLen: 0, TCPAck: 7000, TCPAckSet: true})
+	if info, _ := m.sessions.lookup(tcpKey); info.Attempts != 2 {
+		t.Fatalf("发送次数为 %d，期望 2", info.Attempts)
+	}
+
+	synAck := &layers.TCP{SrcPort: 443, DstPort: 40000, Seq: 9000, Ack: 1001, SYN: true, ACK: true, Window: 1024}
+	if !deliver(t, m, dec, testReply(t, layers.IPProtocolTCP, synAck)) {
+		t.Error("第一次发送 (SYN) 的SYN-ACK未被接受")
+	}
+	rst := &layers.TCP{SrcPort: 443, DstPort: 40000, Seq: 7000, RST: true}
+	if !deliver(t, m, dec, testReply(t, layers.IPProtocolTCP, rst)) {
+		t.Error("第二次发送 (ACK) 的RST未被接受")
+	}
+	stray := &layers.TCP{SrcPort: 443, DstPort: 40000, Seq: 9000, Ack: 3000, SYN: true, ACK: true, Window: 1024}
+	if deliver(t, m, dec, testReply(t, layers.IPProtocolTCP, stray)) {
+		t.Error("确认号不对应任何一次发送的响应被接受")
+	}
+
+}
+
+func TestMatchAcceptsAnyDNSQueryOnSharedKey(t *testing.T) {
+	m, dec := newTestMatcher(t)
+	scanner, target := addrFromIP(net.IP{192, 0, 2, 1}), addrFromIP(net.IP{192, 0, 2, 2})
+
+	// 发往同一解析器且源端口相同的两个DNS查询，较早查询的响应不应因事务ID不同而被拒绝
+	dnsKey := SessionKey{SrcIP: scanner, DstIP: target, Proto: layers.IPProtocolUDP, SrcPort: 53000, DstPort: 53}
+	m.sessions.store(dnsKey, SessionInfo{SentAt: time.Now(), DNSQuery: true, DNSID: 0x1111})
+	m.sessions.store(dnsKey, SessionInfo{SentAt: time.Now(), DNSQuery: true, DNSID: 0x2222})
+	for _, tc := range []struct {
+		id     uint16
+		accept bool
+	}{{0x1111, true}, {0x2222, true}, {0x3333, false}} {
+		dns := testDNS()
+		dns.ID, dns.QR = tc.id, true
+		if got := deliver(t, m, dec, testReply(t, layers.IPProtocolUDP, &layers.UDP{SrcPort: 53, DstPort: 53000}, dns)); got != tc.accept {
+			t.Errorf("事务ID %#04x 的DNS响应: 接受=%v，期望 %v", tc.id, got, tc.accept)
+		}
+	}
+
+	// 被IP分片的响应按首个分片中的DNS报文头匹配
+	dns := testDNS()
+	dns.ID, dns.QR = 0x1111, true
+	udp := &layers.UDP{SrcPort: 53, DstPort: 53000}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, udp, dns); err != nil {
+		t.Fatal(err)
+	}
+	ip := testIPv4(layers.IPProtocolUDP)
+	ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+	ip.Id, ip.Flags = 0x4242, layers.IPv4MoreFragments
+	first := testTemplate(t, ip, gopacket.Payload(buffer.Bytes()))
+	if !deliver(t, m, dec, first.Packet.Data()) {
+		t.Error("较早查询的响应的首个分片未被接受")
+	}
+}
+
+func TestSessionAttemptsBounded(t *testing.T) {
+	table := newSessionTable(time.Minute)
+	key := SessionKey{SrcIP: addrFromIP(net.IP{192, 0, 2, 1}), DstIP: addrFromIP(net.IP{192, 0, 2, 2}), Proto: layers.IPProtocolUDP, SrcPort: 1, DstPort: 2}
+	for i := 0; i < 3*maxSessionAttempts; i++ {
+		table.store(key, SessionInfo{SentAt: time.Now(), DNSQuery: true, DNSID: uint16(i)})
+	}
+	info, ok := table.lookup(key)
+	if !ok {
+		t.Fatal("会话不存在")
+	}
+	if n := len(info.Earlier) + 1; n != maxSessionAttempts {
+		t.Fatalf("保留了 %d 次发送，期望 %d", n, maxSessionAttempts)
+	}
+	// 保留的应是最近的发送，从早到晚排列
+	for i, e := range info.Earlier {
+		if want := uint16(2*maxSessionAttempts + i); e.DNSID != want {
+			t.Fatalf("第 %d 个较早的发送的事务ID为 %d，期望 %d", i, e.DNSID, want)
+		}
+	}
+}
+
+func TestFragmentTableExpires(t *testing.T) {
+	ttl := time.Second
+	start := time.Now()
+	table := newFragmentTable(ttl)
+	table.rotated = start
+	for i := 0; i < 1000; i++ {
+		table.put(fmt.Sprintf("192.0.2.2/%d", i), fragmentOwner{}, start)
+	}
+	if _, ok := table.get("192.0.2.2/1", start.Add(ttl/2)); !ok {
+		t.Fatal("响应窗口内的分片记录丢失")
+	}
+	// 一个响应窗口后记录移入上一代，仍可关联后续分片
+	if _, ok := table.get("192.0.2.2/1", start.Add(ttl)); !ok {
+		t.Fatal("上一代的分片记录丢失")
+	}
+	// 没有新分片到达时，定期轮换也应释放全部过期记录
+	table.rotate(start.Add(3 * ttl))
+	if n := len(table.current) + len(table.previous); n != 0 {
+		t.Fatalf("过期后仍保存 %d 条分片记录", n)
+	}
+	if _, ok := table.get("192.0.2.2/1", start.Add(3*ttl)); ok {
+		t.Fatal("过期的分片记录仍可查到")
+	}
+}
+
+func TestSCTPResponseState(t *testing.T) {
+	// 数据块头: 类型、标志、长度 (含4字节头，不含对齐填充)
+	initAck := []byte{byte(layers.SCTPChunkTypeInitAck), 0, 0, 8, 1, 2, 3, 4}
+	abort := []byte{byte(layers.SCTPChunkTypeAbort), 0, 0, 4}
+	abortT := []byte{byte(layers.SCTPChunkTypeAbort), 1, 0, 4}
+	abortCause := []byte{byte(layers.SCTPChunkTypeAbort), 0, 0, 6, 0, 1, 0, 0}
+	cat := func(chunks ...[]byte) []byte {
+		var b []byte
+		for _, c := range chunks {
+			b = append(b, c...)
+		}
+		return b
+	}
+	cases := []struct {
+		name          string
+		chunks        []byte
+		wantState     string
+		wantReflected bool
+	}{
+		{"INIT-ACK", initAck, sctpPortOpen, false},
+		{"ABORT", abort, sctpPortClosed, false},
+		{"ABORT 带T标志", abortT, sctpPortClosed, true},
+		{"ABORT 后跟 INIT-ACK", cat(abortCause, initAck), sctpPortOpen, false},
+		{"以第一个 ABORT 为准", cat(abort, abortT), sctpPortClosed, false},
+		{"截断的数据块", initAck[:3], "", false},
+		{"长度字段无效", []byte{byte(layers.SCTPChunkTypeInitAck), 0, 0, 2}, "", false},
+		{"无关数据块", []byte{byte(layers.SCTPChunkTypeHeartbeat), 0, 0, 4}, "", false},
+	}
+	for _, tc := range cases {
+		state, reflected := sctpResponseState(tc.chunks)
+		if state != tc.wantState || reflected != tc.wantReflected {
+			t.Errorf("%s: sctpResponseState = (%q, %v)，期望 (%q, %v)", tc.name, state, reflected, tc.wantState, tc.wantReflected)
+		}
+	}
+}
+
+func TestICMPErrorKey(t *testing.T) {
+	// 引用的IPv4头 (20字节) 加TCP头的前8个字节
+	quoted4 := []byte{
+		0x45, 0, 0, 40, 0, 0, 0, 0, 64, byte(layers.IPProtocolTCP), 0, 0,
+		198, 51, 100, 1, 203, 0, 113, 1,
+		0x9c, 0x40, 0, 80, 0, 0, 0, 1,
+	}
+	// 引用的IPv6头 (40字节) 加ICMPv6回显请求的前8个字节
+	quoted6 := make([]byte, 48)
+	quoted6[0], quoted6[6] = 0x60, byte(layers.IPProtocolICMPv6)
+	copy(quoted6[8:24], net.ParseIP("2001:db8:1::1"))
+	copy(quoted6[24:40], net.ParseIP("2001:db8:ffff::1"))
+	copy(quoted6[40:], []byte{byte(layers.ICMPv6TypeEchoRequest), 0, 0, 0, 0x12, 0x34, 0, 7})
+	echoReply6 := append([]byte(nil), quoted6...)
+	echoReply6[40] = byte(layers.ICMPv6TypeEchoReply)
+
+	unreach4 := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)
+	unreach6 := layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)
+	icmp4 := func(typeCode layers.ICMPv4TypeCode, quoted []byte) *layers.ICMPv4 {
+		l := &layers.ICMPv4{TypeCode: typeCode}
+		l.Payload = quoted
+		return l
+	}
+	icmp6 := func(typeCode layers.ICMPv6TypeCode, quoted []byte) *layers.ICMPv6 {
+		l := &layers.ICMPv6{TypeCode: typeCode}
+		l.Payload = append([]byte{0, 0, 0, 0}, quoted...)
+		return l
+	}
+	withIHL := func(ihl byte) []byte {
+		b := append([]byte(nil), quoted4...)
+		b[0] = 0x40 | ihl
+		return b
+	}
+
+	key4 := SessionKey{
+		SrcIP: netip.MustParseAddr("198.51.100.1"), DstIP: netip.MustParseAddr("203.0.113.1"),
+		SrcPort: 40000, DstPort: 80, Proto: layers.IPProtocolTCP,
+	}
+	key6 := SessionKey{
+		SrcIP: netip.MustParseAddr("2001:db8:1::1"), DstIP: netip.MustParseAddr("2001:db8:ffff::1"),
+		SrcPort: 0x1234, DstPort: 7, Proto: layers.IPProtocolICMPv6,
+	}
+	cases := []struct {
+		name   string
+		icmp4  *layers.ICMPv4
+		icmp6  *layers.ICMPv6
+		want   SessionKey
+		wantOK bool
+	}{
+		{name: "IPv4 端口不可达", icmp4: icmp4(unreach4, quoted4), want: key4, wantOK: true},
+		{name: "IPv4 超时", icmp4: icmp4(layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0), quoted4), want: key4, wantOK: true},
+		{name: "IPv4 回显应答不是差错报文", icmp4: icmp4(layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), quoted4)},
+		{name: "IPv4 引用的IP头被截断", icmp4: icmp4(unreach4, quoted4[:19])},
+		{name: "IPv4 IP头长度超出引用数据", icmp4: icmp4(unreach4, withIHL(15))},
+		{name: "IPv4 IP头长度小于20字节", icmp4: icmp4(unreach4, withIHL(4))},
+		{name: "IPv4 传输层不足8字节", icmp4: icmp4(unreach4, quoted4[:27])},
+		{name: "IPv6 回显请求不可达", icmp6: icmp6(unreach6, quoted6), want: key6, wantOK: true},
+		{name: "IPv6 引用的回显应答", icmp6: icmp6(unreach6, echoReply6)},
+		{name: "IPv6 引用的IP头被截断", icmp6: icmp6(unreach6, quoted6[:39])},
+		{name: "IPv6 传输层不足8字节", icmp6: icmp6(unreach6, quoted6[:47])},
+	}
+	for _, tc := range cases {
+		got, ok := icmpErrorKey(tc.icmp4, tc.icmp6)
+		if ok != tc.wantOK || (ok && got != tc.want) {
+			t.Errorf("%s: icmpErrorKey = (%+v, %v)，期望 (%+v, %v)", tc.name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
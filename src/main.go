@@ -23,7 +23,10 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"runtime"
 	"sync"
+	"time"
 )
 
 // 版本信息，在编译时通过 ldflags 注入
@@ -33,14 +36,48 @@ var version = "dev"
 var (
 	srcIPStr   = flag.String("srcIP", "", "源IP地址 (IPv4 或 IPv6)")
 	targetSpec = flag.String("target", "", "目标IP地址，支持CIDR (10.0.0.0/24), 范围 (10.0.0.1-10.0.0.100), 或单个IP (10.0.0.1) 格式。多个目标请用分号分隔 (例如: \"10.0.1.0/24;192.168.1.0-192.168.1.2;172.16.0.1\")。注意：当使用分号分隔多个目标时，请务必将整个参数值用引号括起来。")
-	pcapFile   = flag.String("pcap", "", "用作报文模板的pcap文件路径")
+	pcapFile   = flag.String("pcap", "", "用作报文模板的pcap或pcapng文件路径")
+	templateSpecFile = flag.String("template-spec", "", "JSON或YAML格式 (扩展名为 .yaml 或 .yml) 的声明式模板规范文件路径，可替代 -pcap 或与其同时使用")
 	ifaceName  = flag.String("iface", "", "用于发送和接收报文的网络接口 (例如: eth0)")
 	capture    = flag.Bool("capture", false, "启用响应捕获，并将匹配的响应保存到带时间戳的pcap文件中")
+	captureIface   = flag.String("capture-iface", "", "用于捕获响应的网络接口，多个接口用逗号分隔 (例如: eth1,eth2)，适用于非对称路由或镜像端口；未指定时使用 -iface")
+	responseWindow = flag.Duration("response-window", 5*time.Second, "等待响应的时间窗口: 探测报文的会话在发送后经过该时间过期，发送完成后监听器也等待该时间")
 	pps        = flag.Int("pps", 0, "每秒发送的报文数量 (0 表示不限制)")
+	bandwidth  = flag.String("bandwidth", "", "发送带宽限制，按以太网帧长度计算 (例如: 50Mbit、1.5Gbit)，可与 -pps 同时使用")
+	burst      = flag.Int("burst", 0, "限速时允许连续发送的最大报文数 (令牌桶容量)，0 表示自动 (1毫秒的发送量)")
+	adaptive     = flag.Bool("adaptive", false, "启用自适应速率控制: 根据发送错误、捕获端丢包和响应比例在 -min-pps 与 -max-pps 之间自动调整发包速率，从 -pps (未设置时为 -min-pps) 开始")
+	minPPS       = flag.Int("min-pps", 100, "自适应速率控制的最低发包速率")
+	maxPPS       = flag.Int("max-pps", 0, "自适应速率控制的最高发包速率，启用 -adaptive 时必需")
+	perHostPPS   = flag.Int("per-host-pps", 0, "每个目标每秒最多接收的报文数 (0 表示不限制)，调度器在多个目标之间交替发送模板")
+	perPrefixPPS = flag.Int("per-prefix-pps", 0, "每个网段每秒最多接收的报文数 (0 表示不限制)，网段大小由 -prefix-len 和 -prefix-len6 指定")
+	prefixLen    = flag.Int("prefix-len", 24, "-per-prefix-pps 使用的IPv4网段前缀长度")
+	prefixLen6   = flag.Int("prefix-len6", 64, "-per-prefix-pps 使用的IPv6网段前缀长度")
+	templateFilter = flag.String("template-filter", "", "用于筛选模板的BPF过滤表达式，按每个报文的链路类型离线匹配 (例如: \"tcp[tcpflags] & tcp-syn != 0 and dst port 443\")")
+	templateIndex  = flag.String("template-index", "", "要使用的模板在pcap文件中的序号 (从1开始)，支持逗号分隔的序号和范围 (例如: 1,3,5-9)")
+	truncated      = flag.String("truncated", truncatedSkip, "截断模板 (捕获长度小于原始长度) 的处理方式: skip (警告并跳过), pad (用零字节填充到原始长度), asis (按捕获内容原样发送)")
+	vlanSpec   = flag.String("vlan", "", "为发送的报文添加802.1Q VLAN标签 (例如: 100)。使用逗号分隔两个ID表示QinQ堆叠标签，外层在前 (例如: 100,200)。未指定时保留模板自带的VLAN标签")
+	ttlOverride       = flag.String("ttl", "", "覆盖所有模板的IPv4 TTL或IPv6跳数限制，支持固定值 (64)、范围 (32-128) 或 random")
+	tosOverride       = flag.String("tos", "", "覆盖所有模板的IPv4 TOS或IPv6流量类别 (DSCP值左移2位，例如 EF 为 184)，支持固定值、范围或 random")
+	dfOverride        = flag.String("df", "", "覆盖所有IPv4模板的不分片 (DF) 标志: true、false 或 random")
+	windowOverride    = flag.String("tcp-window", "", "覆盖所有TCP模板的窗口大小，支持固定值、范围或 random")
+	tcpFlagsOverride  = flag.String("tcp-flags", "", "覆盖所有TCP模板的标志位，逗号分隔 (例如: SYN 或 ACK,PSH)")
+	flowLabelOverride = flag.String("flow-label", "", "覆盖所有IPv6模板的流标签，支持固定值、范围或 random")
+	dnsName           = flag.String("dns-name", "", "替换DNS查询模板中的查询名称，支持载荷占位符 (例如: \"{{counter}}.probe.example.com\")")
+	templateMap       = flag.String("template-map", "", "JSON格式的模板映射文件路径，为不同的目标组指定不同的模板 (按pcap文件、模板规范或模板序号)")
+	txBackend         = flag.String("tx-backend", txBackendPcap, "发送后端: pcap (通过libpcap逐个发送) 或 txring (通过AF_PACKET发送环批量发送，仅Linux，不可用时回退到pcap)")
+	workers           = flag.Int("workers", runtime.NumCPU(), "并行发送的协程数量，每个协程拥有独立的发送接口并分得 -pps 的一部分配额 (设置 -per-host-pps 或 -per-prefix-pps 时共用全局配额)")
+	txBatch           = flag.Int("tx-batch", 64, "使用 txring 后端时每次提交给内核的报文数量")
+	rxBackend         = flag.String("rx-backend", rxBackendPcap, "接收后端: pcap (通过libpcap捕获) 或 rxring (通过AF_PACKET TPACKET_V3 接收环捕获，仅Linux，不可用时回退到pcap)")
 	showVersion = flag.Bool("version", false, "显示版本信息并退出")
 )
 
 func main() {
+	// 子命令: inspect 用于在扫描前检查pcap文件中的模板
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		runInspect(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	if *showVersion {
@@ -49,9 +86,9 @@ func main() {
 	}
 
 	// 验证所有必需的命令行参数是否已提供
-	if *targetSpec == "" || *pcapFile == "" || *ifaceName == "" {
+	if *ifaceName == "" || (*templateMap == "" && (*targetSpec == "" || (*pcapFile == "" && *templateSpecFile == ""))) {
 		flag.Usage()
-		log.Fatal("错误: 必须提供所有必需的参数 (-target, -pcap, -iface)。")
+		log.Fatal("错误: 必须提供所有必需的参数 (-target, -pcap 或 -template-spec, -iface)，或使用 -template-map 指定目标和模板。")
 	}
 
 	var srcIP net.IP
@@ -88,43 +125,147 @@ func main() {
 		}
 	}
 
-	// 生成目标IP地址列表
-	targetIPs, err := parseTargetSpec(*targetSpec)
-	if err != nil {
-		log.Fatalf("错误解析目标IP规范: %v", err)
+	// 从pcap文件和模板规范中读取并筛选报文模板
+	var templates []PacketTemplate
+	var err error
+	if *pcapFile != "" || *templateSpecFile != "" {
+		templates, _, err = loadTemplates(*pcapFile, *templateSpecFile, *templateFilter, *templateIndex, *truncated)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(templates) == 0 {
+			log.Fatal("错误: 在pcap文件或模板规范中未找到任何有效的IP/IPv6报文模板。")
+		}
 	}
-	if len(targetIPs) == 0 {
-		log.Fatal("错误: 未从提供的规范生成任何目标IP。")
+
+	// 生成探测计划: -target 指定的目标使用上面的模板，模板映射中的每个目标组使用各自的模板
+	var plan []probeGroup
+	if *targetSpec != "" {
+		if len(templates) == 0 {
+			log.Fatal("错误: 使用 -target 时必须提供 -pcap 或 -template-spec。")
+		}
+		targetIPs, err := parseTargetSpec(*targetSpec)
+		if err != nil {
+			log.Fatalf("错误解析目标IP规范: %v", err)
+		}
+		if len(targetIPs) == 0 {
+			log.Fatal("错误: 未从提供的规范生成任何目标IP。")
+		}
+		plan = append(plan, probeGroup{targets: targetIPs, templates: templates})
+	}
+	if *templateMap != "" {
+		groups, err := loadTemplateMap(*templateMap, templates, *truncated)
+		if err != nil {
+			log.Fatalf("错误加载模板映射: %v", err)
+		}
+		plan = append(plan, groups...)
+	}
+	if len(plan) == 0 {
+		log.Fatal("错误: 模板映射中没有任何目标组。")
 	}
 
-	// 从pcap文件中读取报文模板
-	templates, err := readPcapTemplates(*pcapFile)
+	// 解析VLAN标签规范
+	var vlanIDs []uint16
+	if *vlanSpec != "" {
+		vlanIDs, err = parseVLANSpec(*vlanSpec)
+		if err != nil {
+			log.Fatalf("错误解析VLAN规范: %v", err)
+		}
+	}
+	vlanDepth := len(vlanIDs)
+	if vlanDepth == 0 {
+		for _, group := range plan {
+			if depth := templateVLANDepth(group.templates); depth > vlanDepth {
+				vlanDepth = depth
+			}
+		}
+	}
+
+	// 解析报文头字段覆盖参数
+	overrides, err := parseHeaderOverrides(*ttlOverride, *tosOverride, *dfOverride, *windowOverride, *tcpFlagsOverride, *flowLabelOverride)
 	if err != nil {
-		log.Fatalf("错误读取pcap模板: %v", err)
+		log.Fatalf("错误解析报文头覆盖参数: %v", err)
+	}
+
+	// 检查发送后端参数
+	if *txBackend != txBackendPcap && *txBackend != txBackendTXRing {
+		log.Fatalf("错误: 不支持的发送后端: %s (可选: %s, %s)", *txBackend, txBackendPcap, txBackendTXRing)
+	}
+	if *txBatch < 1 {
+		log.Fatal("错误: -tx-batch 必须大于0。")
+	}
+	if *rxBackend != rxBackendPcap && *rxBackend != rxBackendRXRing {
+		log.Fatalf("错误: 不支持的接收后端: %s (可选: %s, %s)", *rxBackend, rxBackendPcap, rxBackendRXRing)
+	}
+	// 解析捕获接口列表，未指定时在发送接口上捕获
+	captureIfaces := []string{*ifaceName}
+	if *captureIface != "" {
+		captureIfaces, err = parseCaptureIfaces(*captureIface)
+		if err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+	}
+	// 解析速率限制参数
+	var bandwidthBits float64
+	if *bandwidth != "" {
+		bandwidthBits, err = parseBandwidth(*bandwidth)
+		if err != nil {
+			log.Fatalf("错误: %v", err)
+		}
+	}
+	if *pps < 0 || *burst < 0 {
+		log.Fatal("错误: -pps 和 -burst 不能为负数。")
+	}
+	if *perHostPPS < 0 || *perPrefixPPS < 0 {
+		log.Fatal("错误: -per-host-pps 和 -per-prefix-pps 不能为负数。")
+	}
+	if *prefixLen < 0 || *prefixLen > 32 || *prefixLen6 < 0 || *prefixLen6 > 128 {
+		log.Fatal("错误: -prefix-len 必须在 0-32 之间，-prefix-len6 必须在 0-128 之间。")
+	}
+	limits := newHostLimits(*perHostPPS, *perPrefixPPS, *prefixLen, *prefixLen6)
+	var rateControl *adaptiveRate
+	if *adaptive {
+		if *maxPPS <= 0 || *minPPS <= 0 || *minPPS > *maxPPS {
+			log.Fatal("错误: 启用 -adaptive 时必须指定 -max-pps，且 0 < -min-pps <= -max-pps。")
+		}
+		if *pps == 0 {
+			*pps = *minPPS
+		}
+		if *pps < *minPPS || *pps > *maxPPS {
+			log.Fatal("错误: 启用 -adaptive 时 -pps 必须在 -min-pps 与 -max-pps 之间。")
+		}
+		rateControl = newAdaptiveRate(float64(*minPPS), float64(*maxPPS), float64(*pps))
+	}
+	if *responseWindow <= 0 {
+		log.Fatal("错误: -response-window 必须大于0。")
 	}
-	if len(templates) == 0 {
-		log.Fatal("错误: 在pcap文件中未找到任何有效的IP/IPv6报文模板。")
+	if *workers < 1 {
+		log.Fatal("错误: -workers 必须大于0。")
 	}
 
 	// 设置发送和捕获的同步机制
 	var wg sync.WaitGroup
-	sentSessions := make(map[SessionKey]struct{}) // 用于跟踪已发送报文的5元组，以便匹配响应
-	var mu sync.Mutex                             // 用于保护sentSessions map的互斥锁
+	sessions := newSessionTable(*responseWindow) // 用于跟踪已发送报文的5元组，以便匹配响应，会话在响应窗口之后过期
+	results := newScanResults()                  // 用于汇总匹配到的响应
+	stats := &captureStats{}                     // 监听器向自适应速率控制报告的计数
 
 	// 用于通知发送器完成的通道
 	senderDone := make(chan struct{})
 
 	// 如果启用了捕获功能，则启动监听器goroutine
 	if *capture {
+		// 根据探测计划生成捕获过滤器，减少需要在用户空间解码的无关报文
+		captureFilter := buildCaptureFilter(srcIP, plan)
 		wg.Add(1)
-		go listenForResponses(&wg, *ifaceName, srcIP, sentSessions, &mu, senderDone)
+		go listenForResponses(&wg, captureIfaces, captureFilter, sessions, senderDone, vlanDepth, results, stats, *rxBackend)
 	}
 
 	// 启动发送器goroutine
 	wg.Add(1)
-	go sendPackets(&wg, *ifaceName, srcIP, targetIPs, templates, sentSessions, &mu, senderDone, *capture, *pps)
+	go sendPackets(&wg, *ifaceName, srcIP, plan, sessions, senderDone, *capture, *pps, bandwidthBits, *burst, limits, rateControl, stats, *workers, vlanIDs, overrides, *dnsName, *txBackend, *txBatch, results)
 
 	// 等待所有goroutine完成
 	wg.Wait()
+	results.report()
 	log.Println("扫描完成。")
 }
@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// fieldOverride 表示一个报文头字段的覆盖值
+// min 与 max 相同时为固定值，否则每个探测报文在 [min, max] 范围内随机取值
+type fieldOverride struct {
+	set      bool
+	min, max uint32
+}
+
+// headerOverrides 保存应用于所有模板的报文头字段覆盖值
+type headerOverrides struct {
+	ttl       fieldOverride // IPv4 TTL 或 IPv6 跳数限制
+	tos       fieldOverride // IPv4 TOS 或 IPv6 流量类别 (包含DSCP和ECN)
+	df        fieldOverride // IPv4 不分片标志，0 或 1
+	window    fieldOverride // TCP 窗口
+	flowLabel fieldOverride // IPv6 流标签
+	tcpFlags  *layers.TCP   // 仅用于保存解析后的TCP标志位，为nil时不覆盖
+}
+
+// parseFieldOverride 解析字段覆盖值，支持固定值 (64)、范围 (32-128) 或 random (字段的全部取值范围)
+func parseFieldOverride(name, spec string, limit uint32) (fieldOverride, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return fieldOverride{}, nil
+	}
+	if strings.EqualFold(spec, "random") {
+		return fieldOverride{set: true, min: 0, max: limit}, nil
+	}
+	minStr, maxStr := spec, spec
+	if i := strings.Index(spec, "-"); i >= 0 {
+		minStr, maxStr = spec[:i], spec[i+1:]
+	}
+	min, err1 := strconv.ParseUint(strings.TrimSpace(minStr), 0, 32)
+	max, err2 := strconv.ParseUint(strings.TrimSpace(maxStr), 0, 32)
+	if err1 != nil || err2 != nil || min > max || max > uint64(limit) {
+		return fieldOverride{}, fmt.Errorf("无效的 -%s 取值: %s (有效范围 0-%d，或 random)", name, spec, limit)
+	}
+	return fieldOverride{set: true, min: uint32(min), max: uint32(max)}, nil
+}
+
+// value 返回本次探测报文使用的取值
+func (f fieldOverride) value() uint32 {
+	if f.min == f.max {
+		return f.min
+	}
+	return f.min + uint32(rand.Int63n(int64(f.max-f.min)+1))
+}
+
+// random 判断字段是否在每个探测报文中随机取值
+func (f fieldOverride) random() bool {
+	return f.set && f.min != f.max
+}
+
+// parseHeaderOverrides 解析报文头覆盖参数，未设置任何覆盖时返回nil
+func parseHeaderOverrides(ttl, tos, df, window, tcpFlags, flowLabel string) (*headerOverrides, error) {
+	o := &headerOverrides{}
+	var err error
+	if o.ttl, err = parseFieldOverride("ttl", ttl, 255); err != nil {
+		return nil, err
+	}
+	// TTL 随机时不使用0，避免报文在第一跳即被丢弃
+	if o.ttl.set && o.ttl.min == 0 {
+		if o.ttl.max == 0 {
+			return nil, fmt.Errorf("无效的 -ttl 取值: %s (TTL不能为0)", ttl)
+		}
+		o.ttl.min = 1
+	}
+	if o.tos, err = parseFieldOverride("tos", tos, 255); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(strings.TrimSpace(df)) {
+	case "true", "on":
+		df = "1"
+	case "false", "off":
+		df = "0"
+	}
+	if o.df, err = parseFieldOverride("df", df, 1); err != nil {
+		return nil, err
+	}
+	if o.window, err = parseFieldOverride("tcp-window", window, 65535); err != nil {
+		return nil, err
+	}
+	if o.flowLabel, err = parseFieldOverride("flow-label", flowLabel, 0xFFFFF); err != nil {
+		return nil, err
+	}
+	if tcpFlags != "" {
+		o.tcpFlags = &layers.TCP{}
+		if err := setTCPFlags(o.tcpFlags, tcpFlags); err != nil {
+			return nil, fmt.Errorf("无效的 -tcp-flags 取值: %w", err)
+		}
+	}
+
+	if !o.ttl.set && !o.tos.set && !o.df.set && !o.window.set && !o.flowLabel.set && o.tcpFlags == nil {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// applyOverrides 将报文头覆盖值应用到最外层IP头和TCP头
+// 这些字段不参与响应匹配 (地址、端口、ICMP标识符和SCTP标签保持不变)，因此不影响会话跟踪
+func (p *probeLayers) applyOverrides(o *headerOverrides) {
+	if o == nil {
+		return
+	}
+	if p.ip4 != nil {
+		if o.ttl.set {
+			p.ip4.TTL = uint8(o.ttl.value())
+		}
+		if o.tos.set {
+			p.ip4.TOS = uint8(o.tos.value())
+		}
+		if o.df.set {
+			if o.df.value() == 1 {
+				p.ip4.Flags |= layers.IPv4DontFragment
+			} else {
+				p.ip4.Flags &^= layers.IPv4DontFragment
+			}
+		}
+	} else {
+		if o.ttl.set {
+			p.ip6.HopLimit = uint8(o.ttl.value())
+		}
+		if o.tos.set {
+			p.ip6.TrafficClass = uint8(o.tos.value())
+		}
+		if o.flowLabel.set {
+			p.ip6.FlowLabel = o.flowLabel.value()
+		}
+	}
+
+	if p.tcp != nil {
+		if o.window.set {
+			p.tcp.Window = uint16(o.window.value())
+		}
+		if f := o.tcpFlags; f != nil {
+			p.tcp.FIN, p.tcp.SYN, p.tcp.RST, p.tcp.PSH = f.FIN, f.SYN, f.RST, f.PSH
+			p.tcp.ACK, p.tcp.URG, p.tcp.ECE, p.tcp.CWR, p.tcp.NS = f.ACK, f.URG, f.ECE, f.CWR, f.NS
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+
+	"github.com/google/gopacket"
+)
+
+// 载荷占位符的起止标记，例如 {{target_ip}}
+var (
+	placeholderOpen  = []byte("{{")
+	placeholderClose = []byte("}}")
+)
+
+// payloadVars 保存单个探测报文可用于载荷占位符替换的变量
+type payloadVars struct {
+	targetIP   net.IP
+	srcIP      net.IP
+	targetPort uint16
+	srcPort    uint16
+	random     uint32 // 每个探测报文独立的随机数
+	counter    uint64 // 探测报文计数，从0开始
+}
+
+// value 返回占位符名称对应的取值，未知的占位符返回 false
+func (v *payloadVars) value(name string) (string, bool) {
+	switch name {
+	case "target_ip":
+		return v.targetIP.String(), true
+	case "target_port":
+		return strconv.Itoa(int(v.targetPort)), true
+	case "src_ip":
+		return v.srcIP.String(), true
+	case "src_port":
+		return strconv.Itoa(int(v.srcPort)), true
+	case "random":
+		return strconv.FormatUint(uint64(v.random), 10), true
+	case "counter":
+		return strconv.FormatUint(v.counter, 10), true
+	}
+	return "", false
+}
+
+// hasPlaceholders 判断载荷中是否可能包含占位符
+func hasPlaceholders(payload []byte) bool {
+	return bytes.Contains(payload, placeholderOpen)
+}
+
+// substitutePlaceholders 将载荷中的 {{变量名}} 替换为对应的取值，未知的占位符保持原样
+// 返回新的字节切片，不修改传入的模板数据
+func substitutePlaceholders(payload []byte, vars *payloadVars) []byte {
+	var out []byte
+	for {
+		start := bytes.Index(payload, placeholderOpen)
+		if start < 0 {
+			break
+		}
+		end := bytes.Index(payload[start+len(placeholderOpen):], placeholderClose)
+		if end < 0 {
+			break
+		}
+		end += start + len(placeholderOpen)
+		name := string(bytes.TrimSpace(payload[start+len(placeholderOpen) : end]))
+		if value, ok := vars.value(name); ok {
+			out = append(out, payload[:start]...)
+			out = append(out, value...)
+		} else {
+			out = append(out, payload[:end+len(placeholderClose)]...)
+		}
+		payload = payload[end+len(placeholderClose):]
+	}
+	return append(out, payload...)
+}
+
+// substitutePayload 替换探测报文中全部原始字节载荷的占位符，长度和校验和在序列化时重新计算
+func (p *probeLayers) substitutePayload(vars *payloadVars) {
+	for i, layer := range p.stack {
+		if payload, ok := rawPayload(layer); ok && hasPlaceholders(payload) {
+			p.stack[i] = gopacket.Payload(substitutePlaceholders(payload, vars))
+		}
+	}
+}
@@ -19,30 +19,361 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 )
 
-// readPcapTemplates 从pcap文件中读取报文并过滤出IP/IPv6报文
-func readPcapTemplates(filename string) ([]gopacket.Packet, error) {
+// pcapng 文件的块类型和选项代码
+const (
+	pcapngBlockSectionHeader  = 0x0A0D0D0A
+	pcapngBlockPacket         = 2 // 已废弃的 Packet Block
+	pcapngBlockSimplePacket   = 3
+	pcapngBlockEnhancedPacket = 6
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+	pcapngOptionEnd           = 0
+	pcapngOptionComment       = 1
+)
+
+// 截断模板的处理方式
+const (
+	truncatedSkip = "skip" // 警告并跳过截断的模板
+	truncatedPad  = "pad"  // 用零字节填充到原始长度
+	truncatedAsIs = "asis" // 警告后按捕获到的内容原样发送
+)
+
+// PacketTemplate 表示从pcap文件中读取的一个报文模板
+type PacketTemplate struct {
+	Packet    gopacket.Packet
+	Index     int             // 报文在源文件中的序号 (从1开始)
+	Label     string          // 模板标签，取自pcapng中的报文注释
+	LinkType  layers.LinkType // 报文所属接口的链路类型
+	Source    string          // 源文件路径
+	Truncated int             // 因捕获长度 (snaplen) 限制而缺失的字节数，0 表示完整
+}
+
+// SkippedPacket 记录未被用作模板的报文及原因
+type SkippedPacket struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// name 返回用于日志输出的模板名称，包含来源文件，使模板映射中不同文件的同序号模板可以区分
+func (t *PacketTemplate) name() string {
+	return t.ref().String()
+}
+
+// templateRef 在整个探测计划中唯一标识一个模板
+// 不同pcap文件和模板规范中的模板序号都从1开始，因此必须同时记录来源文件
+type templateRef struct {
+	Source string
+	Index  int
+	Label  string
+}
+
+// ref 返回模板的唯一标识
+func (t *PacketTemplate) ref() templateRef {
+	return templateRef{Source: t.Source, Index: t.Index, Label: t.Label}
+}
+
+// String 返回包含来源文件的模板名称
+func (r templateRef) String() string {
+	if r.Label != "" {
+		return fmt.Sprintf("%s #%d (%s)", r.Source, r.Index, r.Label)
+	}
+	return fmt.Sprintf("%s #%d", r.Source, r.Index)
+}
+
+// loadTemplates 读取pcap模板文件，并依次按序号范围、BPF过滤器和截断处理方式筛选模板
+// 如果指定了模板规范文件，其中的模板会追加在pcap模板之后 (不参与筛选)
+// 返回保留的模板以及所有被跳过的报文 (按序号排序)
+func loadTemplates(filename, specFile, filterExpr, indexSpec, truncatedMode string) ([]PacketTemplate, []SkippedPacket, error) {
+	var specTemplates []PacketTemplate
+	if specFile != "" {
+		var err error
+		specTemplates, err = readTemplateSpecs(specFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		if filename == "" {
+			return specTemplates, nil, nil
+		}
+	}
+
+	templates, skipped, err := readPcapTemplates(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("错误读取pcap模板: %w", err)
+	}
+	if filterExpr != "" || indexSpec != "" {
+		var unselected []SkippedPacket
+		templates, unselected, err = selectTemplates(templates, filterExpr, indexSpec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("错误筛选pcap模板: %w", err)
+		}
+		skipped = append(skipped, unselected...)
+	}
+	var truncatedSkipped []SkippedPacket
+	templates, truncatedSkipped, err = applyTruncationPolicy(templates, truncatedMode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("错误处理截断的pcap模板: %w", err)
+	}
+	skipped = append(skipped, truncatedSkipped...)
+
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Index < skipped[j].Index })
+	return append(templates, specTemplates...), skipped, nil
+}
+
+// readPcapTemplates 从pcap或pcapng文件中读取报文并过滤出IP/IPv6报文
+func readPcapTemplates(filename string) ([]PacketTemplate, []SkippedPacket, error) {
+	isNg, err := isPcapngFile(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开pcap文件时出错: %w", err)
+	}
+	if isNg {
+		return readPcapngTemplates(filename)
+	}
+
 	handle, err := pcap.OpenOffline(filename)
 	if err != nil {
-		return nil, fmt.Errorf("打开pcap文件时出错: %w", err)
+		return nil, nil, fmt.Errorf("打开pcap文件时出错: %w", err)
 	}
 	defer handle.Close()
 
-	var templates []gopacket.Packet
+	var templates []PacketTemplate
+	var skipped []SkippedPacket
+	index := 0
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 	for packet := range packetSource.Packets() {
+		index++
 		if packet.Layer(layers.LayerTypeIPv4) != nil || packet.Layer(layers.LayerTypeIPv6) != nil {
-			templates = append(templates, packet)
+			templates = append(templates, PacketTemplate{Packet: packet, Index: index, LinkType: handle.LinkType(), Source: filename, Truncated: truncatedBytes(packet)})
 		} else {
 			log.Printf("跳过pcap文件中的非IP/IPv6报文。")
+			skipped = append(skipped, SkippedPacket{Index: index, Reason: "非IP/IPv6报文"})
+		}
+	}
+	return templates, skipped, nil
+}
+
+// readPcapngTemplates 读取pcapng文件，按每个报文所属接口的链路类型解码，并保留报文注释作为模板标签
+func readPcapngTemplates(filename string) ([]PacketTemplate, []SkippedPacket, error) {
+	comments, err := readPcapngComments(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取pcapng报文注释时出错: %w", err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开pcapng文件时出错: %w", err)
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析pcapng文件时出错: %w", err)
+	}
+
+	var templates []PacketTemplate
+	var skipped []SkippedPacket
+	index := 0
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("读取pcapng报文时出错: %w", err)
+		}
+		index++
+
+		linkType := r.LinkType()
+		if len(ci.AncillaryData) > 0 {
+			if lt, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+				linkType = lt
+			}
+		}
+		packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+
+		if packet.Layer(layers.LayerTypeIPv4) != nil || packet.Layer(layers.LayerTypeIPv6) != nil {
+			templates = append(templates, PacketTemplate{Packet: packet, Index: index, Label: comments[index], LinkType: linkType, Source: filename, Truncated: truncatedBytes(packet)})
+		} else {
+			log.Printf("跳过pcapng文件中的非IP/IPv6报文 #%d (链路类型 %s)。", index, linkType)
+			skipped = append(skipped, SkippedPacket{Index: index, Reason: fmt.Sprintf("非IP/IPv6报文 (链路类型 %s)", linkType)})
+		}
+	}
+	return templates, skipped, nil
+}
+
+// truncatedBytes 返回报文因捕获长度限制而缺失的字节数
+// 除了比较捕获长度和原始长度外，IP头的总长度字段超出实际数据时也视为截断
+// 注意: 不能依赖 Metadata().Truncated，应用层 (如非DNS载荷被当作DNS) 解码失败时同样会设置该标志
+func truncatedBytes(packet gopacket.Packet) int {
+	ci := packet.Metadata().CaptureInfo
+	if missing := ci.Length - ci.CaptureLength; missing > 0 {
+		return missing
+	}
+	if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		if missing := int(ip4.Length) - len(ip4.Contents) - len(ip4.Payload); missing > 0 {
+			return missing
+		}
+	} else if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		if missing := int(ip6.Length) - len(ip6.Payload); ip6.Length != 0 && missing > 0 {
+			return missing
+		}
+	}
+	return 0
+}
+
+// applyTruncationPolicy 按指定方式处理截断的模板: 跳过、填充到原始长度或原样保留
+func applyTruncationPolicy(templates []PacketTemplate, mode string) ([]PacketTemplate, []SkippedPacket, error) {
+	switch mode {
+	case truncatedSkip, truncatedPad, truncatedAsIs:
+	default:
+		return nil, nil, fmt.Errorf("无效的截断模板处理方式: %s (可选值: %s, %s, %s)", mode, truncatedSkip, truncatedPad, truncatedAsIs)
+	}
+
+	var kept []PacketTemplate
+	var skipped []SkippedPacket
+	for _, template := range templates {
+		if template.Truncated == 0 {
+			kept = append(kept, template)
+			continue
+		}
+		switch mode {
+		case truncatedSkip:
+			log.Printf("警告: 模板 %s 被截断 (缺失 %d 字节)，跳过此模板。可使用 -truncated %s 或 %s 改变处理方式。", template.name(), template.Truncated, truncatedPad, truncatedAsIs)
+			skipped = append(skipped, SkippedPacket{Index: template.Index, Reason: fmt.Sprintf("报文被截断 (缺失 %d 字节)", template.Truncated)})
+			continue
+		case truncatedPad:
+			data := append(append([]byte{}, template.Packet.Data()...), make([]byte, template.Truncated)...)
+			ci := template.Packet.Metadata().CaptureInfo
+			ci.CaptureLength = len(data)
+			if ci.Length < ci.CaptureLength {
+				ci.Length = ci.CaptureLength
+			}
+			template.Packet = gopacket.NewPacket(data, template.LinkType, gopacket.Default)
+			template.Packet.Metadata().CaptureInfo = ci
+			log.Printf("警告: 模板 %s 被截断，已用零字节填充 %d 字节到原始长度。", template.name(), template.Truncated)
+		case truncatedAsIs:
+			log.Printf("警告: 模板 %s 被截断 (缺失 %d 字节)，将按捕获到的内容原样发送。", template.name(), template.Truncated)
+		}
+		kept = append(kept, template)
+	}
+	return kept, skipped, nil
+}
+
+// isPcapngFile 根据文件头的魔数判断文件是否为pcapng格式
+func isPcapngFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(magic[:]) == pcapngBlockSectionHeader, nil
+}
+
+// readPcapngComments 遍历pcapng文件中的所有块，返回报文序号 (从1开始) 到报文注释 (opt_comment) 的映射
+// pcapgo.NgReader 不提供报文块的选项，因此在此单独解析
+func readPcapngComments(filename string) (map[int]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	comments := make(map[int]string)
+	var order binary.ByteOrder = binary.LittleEndian
+	index := 0
+	header := make([]byte, 12)
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			if err == io.EOF {
+				return comments, nil
+			}
+			return nil, err
+		}
+
+		// 节头块决定后续所有块的字节序
+		if binary.LittleEndian.Uint32(header[:4]) == pcapngBlockSectionHeader {
+			if _, err := io.ReadFull(r, header[8:12]); err != nil {
+				return nil, err
+			}
+			if binary.BigEndian.Uint32(header[8:12]) == pcapngByteOrderMagic {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			length := int(order.Uint32(header[4:8]))
+			if length < 12 {
+				return nil, fmt.Errorf("无效的节头块长度: %d", length)
+			}
+			if _, err := r.Discard(length - 12); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		blockType := order.Uint32(header[:4])
+		length := int(order.Uint32(header[4:8]))
+		if length < 12 {
+			return nil, fmt.Errorf("无效的块长度: %d", length)
+		}
+		body := make([]byte, length-12)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(4); err != nil { // 块末尾重复的长度字段
+			return nil, err
+		}
+
+		var options []byte
+		switch blockType {
+		case pcapngBlockEnhancedPacket, pcapngBlockPacket:
+			index++
+			if len(body) < 20 {
+				continue
+			}
+			captureLength := int(order.Uint32(body[12:16]))
+			offset := 20 + (captureLength+3)&^3
+			if offset < len(body) {
+				options = body[offset:]
+			}
+		case pcapngBlockSimplePacket:
+			index++
+		}
+
+		// 在选项中查找注释
+		for len(options) >= 4 {
+			code := order.Uint16(options[:2])
+			optLen := int(order.Uint16(options[2:4]))
+			if code == pcapngOptionEnd || 4+optLen > len(options) {
+				break
+			}
+			if code == pcapngOptionComment {
+				comments[index] = string(options[4 : 4+optLen])
+				break
+			}
+			next := 4 + (optLen+3)&^3
+			if next > len(options) {
+				break
+			}
+			options = options[next:]
 		}
 	}
-	return templates, nil
 }
@@ -0,0 +1,379 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// probeLayers 保存从模板中提取的、链路层之后的全部层，以及便于修改和会话匹配的关键层引用
+type probeLayers struct {
+	stack    []gopacket.SerializableLayer // 从最外层IP开始的全部层，保持模板中的原始顺序
+	vlans    []*layers.Dot1Q              // 模板自带的VLAN标签
+	ip4      *layers.IPv4                 // 最外层IPv4头
+	ip6      *layers.IPv6                 // 最外层IPv6头
+	tcp      *layers.TCP
+	udp      *layers.UDP
+	icmp4    *layers.ICMPv4     // ICMPv4回显请求
+	echo6    *layers.ICMPv6Echo // ICMPv6回显请求
+	sctp     *layers.SCTP       // SCTP公共头
+	sctpInit *layers.SCTPInit   // SCTP INIT块
+	dns      *layers.DNS        // UDP承载的DNS查询
+
+	dropped []gopacket.LayerType // 被丢弃并重新构建的链路层 (VLAN标签除外)
+	raw     []gopacket.LayerType // 无法序列化、以原始字节保留的层
+}
+
+// probeIdentity 保存每个探测报文独有的字段取值，用于将响应与探测报文一一对应
+type probeIdentity struct {
+	echoID   uint16 // ICMP回显标识符
+	echoSeq  uint16 // ICMP回显序列号
+	tcpSeq   uint32 // TCP初始序列号
+	tcpAck   uint32 // TCP确认号 (仅在ACK标志置位时使用)
+	tsval    uint32 // TCP时间戳选项的TSval
+	tsecr    uint32 // TCP时间戳选项的TSecr (仅在ACK标志置位时使用)
+	sctpPort uint16 // SCTP INIT的源端口
+	sctpTag  uint32 // SCTP INIT的发起标签
+	dnsID    uint16 // DNS查询的事务ID
+}
+
+// probeSummary 描述探测报文中用于会话跟踪和结果统计的信息
+type probeSummary struct {
+	proto     layers.IPProtocol
+	srcPort   uint16
+	dstPort   uint16
+	echo      bool   // ICMP回显请求
+	tcp       bool   // TCP探测
+	tcpAckSet bool   // TCP探测置位了ACK标志
+	tcpLen    uint32 // TCP探测占用的序列号空间
+	sctpInit  bool   // SCTP INIT探测
+	dns       bool   // UDP承载的DNS查询
+}
+
+// checksumLayer 表示校验和依赖IP伪首部的层 (TCP, UDP, UDPLite, ICMPv6 等)
+type checksumLayer interface {
+	SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+}
+
+// extractProbeLayers 从模板中提取最外层IP及其之后的全部层
+// 能够序列化的层按原样保留 (ICMP, SCTP, GRE, IPv4选项, IPv6扩展头等)，无法序列化的层以原始字节保留
+func extractProbeLayers(templatePacket gopacket.Packet) (*probeLayers, error) {
+	p := &probeLayers{}
+	var icmp6 *layers.ICMPv6
+	for _, layer := range templatePacket.Layers() {
+		if len(p.stack) == 0 {
+			// 最外层IP之前的链路层将被重新构建，仅记录VLAN标签
+			switch l := layer.(type) {
+			case *layers.Dot1Q:
+				p.vlans = append(p.vlans, l)
+				continue
+			case *layers.IPv4:
+				p.ip4 = l
+			case *layers.IPv6:
+				p.ip6 = l
+			default:
+				p.dropped = append(p.dropped, layer.LayerType())
+				continue
+			}
+		}
+
+		switch l := layer.(type) {
+		case *layers.TCP:
+			if p.tcp == nil && p.udp == nil && p.sctp == nil {
+				p.tcp = l
+			}
+		case *layers.UDP:
+			if p.tcp == nil && p.udp == nil && p.sctp == nil {
+				p.udp = l
+			}
+		case *layers.SCTP:
+			if p.tcp == nil && p.udp == nil && p.sctp == nil {
+				p.sctp = l
+			}
+		case *layers.SCTPInit:
+			if p.sctpInit == nil && p.sctp != nil && l.Type == layers.SCTPChunkTypeInit {
+				p.sctpInit = l
+			}
+		case *layers.DNS:
+			if p.dns == nil && p.udp != nil && !l.QR {
+				p.dns = l
+			}
+		case *layers.ICMPv4:
+			if p.icmp4 == nil && l.TypeCode.Type() == layers.ICMPv4TypeEchoRequest {
+				p.icmp4 = l
+			}
+		case *layers.ICMPv6:
+			if icmp6 == nil {
+				icmp6 = l
+			}
+		case *layers.ICMPv6Echo:
+			if p.echo6 == nil && icmp6 != nil && icmp6.TypeCode.Type() == layers.ICMPv6TypeEchoRequest {
+				p.echo6 = l
+			}
+		}
+
+		if s, ok := layer.(gopacket.SerializableLayer); ok {
+			p.stack = append(p.stack, s)
+			// gopacket 解码ICMPv6回显时不会保留其后的回显数据，需从ICMPv6层的载荷中补回
+			if _, ok := layer.(*layers.ICMPv6Echo); ok && icmp6 != nil && len(icmp6.LayerPayload()) > 4 {
+				p.stack = append(p.stack, gopacket.Payload(icmp6.LayerPayload()[4:]))
+			}
+		} else if contents := layer.LayerContents(); len(contents) > 0 {
+			p.stack = append(p.stack, gopacket.Payload(contents))
+			p.raw = append(p.raw, layer.LayerType())
+		}
+	}
+
+	if len(p.stack) == 0 {
+		return nil, fmt.Errorf("报文模板没有IPv4或IPv6层")
+	}
+	return p, nil
+}
+
+// rawPayload 返回以原始字节保存的层内容，解码得到的载荷层为 *gopacket.Payload，补回的载荷为 gopacket.Payload
+func rawPayload(layer gopacket.SerializableLayer) ([]byte, bool) {
+	switch l := layer.(type) {
+	case gopacket.Payload:
+		return l, true
+	case *gopacket.Payload:
+		return *l, true
+	}
+	return nil, false
+}
+
+// rewriteAddresses 替换最外层IP头的源和目的地址，并为依赖伪首部的层关联其所属的网络层
+// 内层封装 (如GRE隧道内的IP报文) 的地址保持不变
+func (p *probeLayers) rewriteAddresses(srcIP, dstIP net.IP) error {
+	if p.ip4 != nil {
+		if srcIP.To4() == nil || dstIP.To4() == nil {
+			return fmt.Errorf("IPv4模板无法发送到 %s (源地址 %s)", dstIP, srcIP)
+		}
+		p.ip4.SrcIP = srcIP
+		p.ip4.DstIP = dstIP
+	} else {
+		if srcIP.To4() != nil || dstIP.To4() != nil {
+			return fmt.Errorf("IPv6模板无法发送到 %s (源地址 %s)", dstIP, srcIP)
+		}
+		p.ip6.SrcIP = srcIP
+		p.ip6.DstIP = dstIP
+	}
+
+	var network gopacket.NetworkLayer
+	for _, layer := range p.stack {
+		if n, ok := layer.(gopacket.NetworkLayer); ok {
+			network = n
+		}
+		if c, ok := layer.(checksumLayer); ok && network != nil {
+			if err := c.SetNetworkLayerForChecksum(network); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isEcho 判断模板是否为ICMPv4或ICMPv6回显请求
+func (p *probeLayers) isEcho() bool {
+	return p.icmp4 != nil || p.echo6 != nil
+}
+
+// setEchoIdentity 设置回显请求的标识符和序列号，使每个探测报文都能与其应答一一对应
+func (p *probeLayers) setEchoIdentity(id, seq uint16) {
+	if p.icmp4 != nil {
+		p.icmp4.Id = id
+		p.icmp4.Seq = seq
+	} else if p.echo6 != nil {
+		p.echo6.Identifier = id
+		p.echo6.SeqNumber = seq
+	}
+}
+
+// setSCTPIdentity 为SCTP INIT探测设置源端口和发起标签 (Initiate Tag)
+// 根据 RFC 4960，INIT报文公共头的验证标签必须为0，对端的INIT-ACK和ABORT会以发起标签作为验证标签
+func (p *probeLayers) setSCTPIdentity(srcPort uint16, tag uint32) {
+	p.sctp.SrcPort = layers.SCTPPort(srcPort)
+	p.sctp.VerificationTag = 0
+	p.sctpInit.InitiateTag = tag
+}
+
+// setTCPIdentity 为TCP探测设置初始序列号和确认号 (仅在ACK标志置位时)，并改写时间戳选项
+// 模板中的SACK块随确认号一同平移，保持与确认号的相对关系；SYN报文的TSecr保持为0
+func (p *probeLayers) setTCPIdentity(seq, ack, tsval, tsecr uint32) {
+	delta := uint32(0)
+	if p.tcp.ACK {
+		delta = ack - p.tcp.Ack
+		p.tcp.Ack = ack
+	}
+	p.tcp.Seq = seq
+
+	// 选项数据引用模板的原始字节，修改前先复制
+	options := make([]layers.TCPOption, len(p.tcp.Options))
+	for i, opt := range p.tcp.Options {
+		switch {
+		case opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8:
+			opt.OptionData = make([]byte, 8)
+			binary.BigEndian.PutUint32(opt.OptionData, tsval)
+			if p.tcp.ACK {
+				binary.BigEndian.PutUint32(opt.OptionData[4:], tsecr)
+			}
+		case opt.OptionType == layers.TCPOptionKindSACK && delta != 0:
+			data := make([]byte, len(opt.OptionData))
+			copy(data, opt.OptionData)
+			for j := 0; j+4 <= len(data); j += 4 {
+				binary.BigEndian.PutUint32(data[j:], binary.BigEndian.Uint32(data[j:])+delta)
+			}
+			opt.OptionData = data
+		}
+		options[i] = opt
+	}
+	p.tcp.Options = options
+}
+
+// setDNSIdentity 设置DNS查询的事务ID，name 非空时同时替换第一个问题的查询名称
+func (p *probeLayers) setDNSIdentity(id uint16, name string) {
+	p.dns.ID = id
+	if name != "" && len(p.dns.Questions) > 0 {
+		p.dns.Questions[0].Name = []byte(name)
+	}
+}
+
+// tcpSequenceSpace 返回TCP探测占用的序列号空间 (载荷长度，SYN和FIN标志各占1)
+func (p *probeLayers) tcpSequenceSpace() uint32 {
+	n := uint32(p.bytesAfter(p.tcp))
+	if p.tcp.SYN {
+		n++
+	}
+	if p.tcp.FIN {
+		n++
+	}
+	return n
+}
+
+// bytesAfter 返回序列化时 header 之后各层的字节数
+func (p *probeLayers) bytesAfter(header gopacket.SerializableLayer) int {
+	n := 0
+	after := false
+	for _, layer := range p.stack {
+		if after {
+			if l, ok := layer.(gopacket.Layer); ok {
+				n += len(l.LayerContents())
+			}
+		} else if layer == header {
+			after = true
+		}
+	}
+	return n
+}
+
+// payloadLength 返回探测报文头 (TCP、UDP、SCTP或ICMP回显) 之后发送的字节数，没有这些报文头时返回false
+// 与发送时一致，ICMPv6回显数据也计算在内 (gopacket 不将其解码为应用层)
+func (p *probeLayers) payloadLength() (int, bool) {
+	switch {
+	case p.tcp != nil:
+		return p.bytesAfter(p.tcp), true
+	case p.udp != nil:
+		return p.bytesAfter(p.udp), true
+	case p.sctp != nil:
+		return p.bytesAfter(p.sctp), true
+	case p.icmp4 != nil:
+		return p.bytesAfter(p.icmp4), true
+	case p.echo6 != nil:
+		return p.bytesAfter(p.echo6), true
+	}
+	return 0, false
+}
+
+// ports 返回传输层 (TCP, UDP, SCTP) 的源端口和目的端口，其他协议返回0
+func (p *probeLayers) ports() (srcPort, dstPort uint16) {
+	switch {
+	case p.sctp != nil:
+		return uint16(p.sctp.SrcPort), uint16(p.sctp.DstPort)
+	case p.tcp != nil:
+		return uint16(p.tcp.SrcPort), uint16(p.tcp.DstPort)
+	case p.udp != nil:
+		return uint16(p.udp.SrcPort), uint16(p.udp.DstPort)
+	}
+	return 0, 0
+}
+
+// applyIdentity 将探测报文独有的字段取值写入对应的层
+func (p *probeLayers) applyIdentity(id *probeIdentity) {
+	if p.isEcho() {
+		p.setEchoIdentity(id.echoID, id.echoSeq)
+	}
+	if p.tcp != nil {
+		p.setTCPIdentity(id.tcpSeq, id.tcpAck, id.tsval, id.tsecr)
+	}
+	if p.sctpInit != nil {
+		p.setSCTPIdentity(id.sctpPort, id.sctpTag)
+	}
+	if p.dns != nil {
+		p.setDNSIdentity(id.dnsID, "")
+	}
+}
+
+// summary 返回探测报文用于会话跟踪和结果统计的信息
+func (p *probeLayers) summary() probeSummary {
+	s := probeSummary{
+		proto:    p.protocol(),
+		echo:     p.isEcho(),
+		tcp:      p.tcp != nil,
+		sctpInit: p.sctpInit != nil,
+		dns:      p.dns != nil,
+	}
+	s.srcPort, s.dstPort = p.ports()
+	if p.tcp != nil {
+		s.tcpAckSet = p.tcp.ACK
+		s.tcpLen = p.tcpSequenceSpace()
+	}
+	return s
+}
+
+// ethernetType 返回最外层IP对应的以太网类型
+func (p *probeLayers) ethernetType() layers.EthernetType {
+	if p.ip6 != nil {
+		return layers.EthernetTypeIPv6
+	}
+	return layers.EthernetTypeIPv4
+}
+
+// protocol 返回用于会话匹配的传输层协议
+func (p *probeLayers) protocol() layers.IPProtocol {
+	switch {
+	case p.icmp4 != nil:
+		return layers.IPProtocolICMPv4
+	case p.echo6 != nil:
+		return layers.IPProtocolICMPv6
+	case p.sctp != nil:
+		return layers.IPProtocolSCTP
+	case p.tcp != nil:
+		return layers.IPProtocolTCP
+	case p.udp != nil:
+		return layers.IPProtocolUDP
+	case p.ip4 != nil:
+		return p.ip4.Protocol
+	default:
+		return p.ip6.NextHeader
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 未指定 -burst 时令牌桶的容量 (按时间计)
+	defaultBurstWindow = time.Millisecond
+	// 等待时间超过该值时先休眠，剩余部分自旋等待，以获得微秒级的发送间隔
+	pacerSpinThreshold = 2 * time.Millisecond
+)
+
+// pacer 是按报文数和带宽限速的令牌桶
+// 令牌以时间表示: 每个报文消耗 max(1/pps, 帧长/带宽) 的发送时间，桶的容量为 burst 个报文的发送时间，
+// 空闲后累积的令牌允许连续发送至多 burst 个报文
+// 可由多个发送协程共用: 每个报文在锁内预约发送时间，等待在锁外进行
+type pacer struct {
+	pps       atomic.Uint64 // 每秒报文数 (float64的位表示)，0 表示不限制，自适应速率控制可并发修改
+	bandwidth float64       // 每秒比特数 (按以太网帧长度计算)，0 表示不限制
+	burst     int           // 令牌桶容量 (报文数)，0 表示自动
+	lead      int           // 允许提前排队的报文数 (一个发送批次)，提前量用尽时才提交并等待
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newPacer 创建限速器，pps 与 bandwidth 均为0时返回nil (不限速)
+func newPacer(pps, bandwidth float64, burst, batch int) *pacer {
+	if pps <= 0 && bandwidth <= 0 {
+		return nil
+	}
+	if batch < 1 {
+		batch = 1
+	}
+	p := &pacer{bandwidth: bandwidth, burst: burst, lead: batch - 1}
+	p.setRate(pps)
+	return p
+}
+
+// setRate 修改每秒报文数限制，可在发送过程中由其他协程调用
+func (p *pacer) setRate(pps float64) {
+	p.pps.Store(math.Float64bits(pps))
+}
+
+// cost 返回发送一个长度为 frameLen 的帧所消耗的时间
+func (p *pacer) cost(frameLen int) time.Duration {
+	var c float64
+	if pps := math.Float64frombits(p.pps.Load()); pps > 0 {
+		c = float64(time.Second) / pps
+	}
+	if p.bandwidth > 0 {
+		if b := float64(frameLen*8) * float64(time.Second) / p.bandwidth; b > c {
+			c = b
+		}
+	}
+	return time.Duration(c)
+}
+
+// wait 在发送长度为 frameLen 的帧之前调用，必要时阻塞直到令牌足够
+// 需要等待时先调用 flush 提交已排队的报文，使排队的报文不会因等待而延迟发送
+func (p *pacer) wait(frameLen int, flush func()) {
+	c := p.cost(frameLen)
+	now := time.Now()
+
+	p.mu.Lock()
+	// 空闲期间累积的令牌不超过桶的容量
+	window := defaultBurstWindow
+	if p.burst > 0 {
+		window = time.Duration(p.burst) * c
+	}
+	if window < c {
+		window = c
+	}
+	if floor := now.Add(-window); p.next.Before(floor) {
+		p.next = floor
+	}
+	at := p.next
+	p.next = p.next.Add(c)
+	p.mu.Unlock()
+
+	// 允许提前一个批次的发送时间，超出后提交已排队的报文并等待
+	if at.Sub(now) > time.Duration(p.lead)*c {
+		flush()
+		sleepUntil(at)
+	}
+}
+
+// sleepUntil 高精度地等待到指定时间: 较长的等待先休眠，最后一段自旋等待
+func sleepUntil(t time.Time) {
+	if d := time.Until(t); d > pacerSpinThreshold {
+		time.Sleep(d - pacerSpinThreshold/2)
+	}
+	for time.Now().Before(t) {
+		runtime.Gosched()
+	}
+}
+
+// parseBandwidth 解析带宽参数，返回每秒比特数
+// 支持 k、M、G、T 十进制前缀和可选的 bit、bps、bit/s 单位 (例如: 50Mbit、1.5Gbps、800k、1000000)
+func parseBandwidth(spec string) (float64, error) {
+	s := strings.ToLower(strings.TrimSpace(spec))
+	for _, unit := range []string{"bit/s", "bits", "bit", "bps"} {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit))
+			break
+		}
+	}
+	multiplier := 1.0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			multiplier = 1e3
+		case 'm':
+			multiplier = 1e6
+		case 'g':
+			multiplier = 1e9
+		case 't':
+			multiplier = 1e12
+		}
+		if multiplier != 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("无效的带宽: %s (例如: 50Mbit、1.5Gbit、800kbit)", spec)
+	}
+	return v * multiplier, nil
+}
+
+// formatBitRate 以 kbit/s、Mbit/s 或 Gbit/s 表示比特率
+func formatBitRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	default:
+		return fmt.Sprintf("%.2f kbit/s", bps/1e3)
+	}
+}
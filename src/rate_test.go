@@ -0,0 +1,75 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import "testing"
+
+func TestParseBandwidth(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    float64
+		wantErr bool
+	}{
+		{spec: "1000000", want: 1e6},
+		{spec: "800k", want: 800e3},
+		{spec: "800kbit", want: 800e3},
+		{spec: "50Mbit", want: 50e6},
+		{spec: "50 Mbit/s", want: 50e6},
+		{spec: "1.5Gbps", want: 1.5e9},
+		{spec: "1.5gbits", want: 1.5e9},
+		{spec: "2T", want: 2e12},
+		{spec: "k", wantErr: true},
+		{spec: "kbit", wantErr: true},
+		{spec: "", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "0Mbit", wantErr: true},
+		{spec: "-1", wantErr: true},
+		{spec: "fast", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseBandwidth(tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseBandwidth(%q) = %v，期望返回错误", tc.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBandwidth(%q): %v", tc.spec, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseBandwidth(%q) = %v，期望 %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestFormatBitRate(t *testing.T) {
+	cases := map[float64]string{
+		800e3:  "800.00 kbit/s",
+		50e6:   "50.00 Mbit/s",
+		1.5e9:  "1.50 Gbit/s",
+		999999: "1000.00 kbit/s",
+	}
+	for bps, want := range cases {
+		if got := formatBitRate(bps); got != want {
+			t.Errorf("formatBitRate(%v) = %q，期望 %q", bps, got, want)
+		}
+	}
+}
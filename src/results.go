@@ -0,0 +1,392 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// SCTP端口状态
+const (
+	sctpPortNoResponse = "无响应"
+	sctpPortOpen       = "开放"
+	sctpPortClosed     = "关闭"
+)
+
+// dnsResponse 记录一个匹配到的DNS响应
+type dnsResponse struct {
+	Port    uint16
+	Name    string
+	RCode   layers.DNSResponseCode
+	Answers int
+	Open    bool // 是否为开放解析器: 支持递归且对递归查询返回了应答
+}
+
+// udpAmplification 统计UDP探测的请求与响应流量 (按IP层长度)，用于计算放大倍数
+type udpAmplification struct {
+	Probes        int
+	SentBytes     int
+	Responses     int
+	ResponseBytes int
+}
+
+// add 累加另一组流量统计
+func (a *udpAmplification) add(other *udpAmplification) {
+	a.Probes += other.Probes
+	a.SentBytes += other.SentBytes
+	a.Responses += other.Responses
+	a.ResponseBytes += other.ResponseBytes
+}
+
+// factors 返回带宽放大倍数 (响应字节数/请求字节数) 和报文放大倍数 (响应报文数/请求报文数)
+func (a *udpAmplification) factors() (bandwidth, packets float64) {
+	if a.SentBytes > 0 {
+		bandwidth = float64(a.ResponseBytes) / float64(a.SentBytes)
+	}
+	if a.Probes > 0 {
+		packets = float64(a.Responses) / float64(a.Probes)
+	}
+	return bandwidth, packets
+}
+
+// hostResult 记录单个目标主机的ICMP回显、SCTP端口、DNS和UDP放大探测结果
+type hostResult struct {
+	EchoSent    int
+	EchoReplies int
+	MinRTT      time.Duration
+	MaxRTT      time.Duration
+	TotalRTT    time.Duration
+	SCTPPorts   map[uint16]string // SCTP目标端口 -> 端口状态
+	DNSSent     int
+	DNSReplies  []dnsResponse
+	UDP         map[templateRef]*udpAmplification // 模板 -> UDP流量统计
+}
+
+// scanResults 汇总扫描过程中匹配到的响应，并在扫描结束时输出
+type scanResults struct {
+	mu    sync.Mutex
+	hosts map[string]*hostResult
+}
+
+// newScanResults 创建一个空的扫描结果集合
+func newScanResults() *scanResults {
+	return &scanResults{hosts: make(map[string]*hostResult)}
+}
+
+// host 返回指定主机的结果记录，不存在时创建，调用方需持有锁
+func (r *scanResults) host(ip string) *hostResult {
+	h, ok := r.hosts[ip]
+	if !ok {
+		h = &hostResult{}
+		r.hosts[ip] = h
+	}
+	return h
+}
+
+// recordEchoRequest 记录向主机发送了一个回显请求
+func (r *scanResults) recordEchoRequest(ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.host(ip).EchoSent++
+}
+
+// recordEchoReply 记录收到主机的回显应答及其往返时延
+func (r *scanResults) recordEchoReply(ip string, rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.host(ip)
+	if h.EchoReplies == 0 || rtt < h.MinRTT {
+		h.MinRTT = rtt
+	}
+	if rtt > h.MaxRTT {
+		h.MaxRTT = rtt
+	}
+	h.TotalRTT += rtt
+	h.EchoReplies++
+}
+
+// recordSCTPInit 记录向主机的SCTP端口发送了一个INIT探测
+func (r *scanResults) recordSCTPInit(ip string, port uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.host(ip)
+	if h.SCTPPorts == nil {
+		h.SCTPPorts = make(map[uint16]string)
+	}
+	if _, ok := h.SCTPPorts[port]; !ok {
+		h.SCTPPorts[port] = sctpPortNoResponse
+	}
+}
+
+// recordSCTPResponse 根据INIT-ACK (开放) 或 ABORT (关闭) 响应记录SCTP端口状态
+func (r *scanResults) recordSCTPResponse(ip string, port uint16, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.host(ip)
+	if h.SCTPPorts == nil {
+		h.SCTPPorts = make(map[uint16]string)
+	}
+	// 已确认开放的端口不会被后续的ABORT覆盖
+	if h.SCTPPorts[port] != sctpPortOpen {
+		h.SCTPPorts[port] = state
+	}
+}
+
+// recordDNSQuery 记录向主机发送了一个DNS查询
+func (r *scanResults) recordDNSQuery(ip string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.host(ip).DNSSent++
+}
+
+// recordDNSResponse 记录主机返回的DNS响应码和应答数量
+// 对设置了RD标志的查询，响应设置了RA标志、响应码为NOERROR且包含应答时，认为该主机是开放解析器
+func (r *scanResults) recordDNSResponse(ip string, port uint16, dns *layers.DNS) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := dnsResponse{
+		Port:    port,
+		RCode:   dns.ResponseCode,
+		Answers: int(dns.ANCount),
+		Open:    dns.RD && dns.RA && dns.ResponseCode == layers.DNSResponseCodeNoErr && dns.ANCount > 0,
+	}
+	if len(dns.Questions) > 0 {
+		resp.Name = string(dns.Questions[0].Name)
+	}
+	h := r.host(ip)
+	h.DNSReplies = append(h.DNSReplies, resp)
+}
+
+// udp 返回主机在指定模板上的UDP流量统计，不存在时创建，调用方需持有锁
+func (h *hostResult) udp(template templateRef) *udpAmplification {
+	if h.UDP == nil {
+		h.UDP = make(map[templateRef]*udpAmplification)
+	}
+	a, ok := h.UDP[template]
+	if !ok {
+		a = &udpAmplification{}
+		h.UDP[template] = a
+	}
+	return a
+}
+
+// recordUDPProbe 记录使用指定模板向主机发送了一个UDP探测
+func (r *scanResults) recordUDPProbe(ip string, template templateRef, length int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.host(ip).udp(template)
+	a.Probes++
+	a.SentBytes += length
+}
+
+// recordUDPResponse 记录一个与UDP探测匹配的响应报文 (包括响应的后续IP分片)
+func (r *scanResults) recordUDPResponse(ip string, template templateRef, length int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.host(ip).udp(template)
+	a.Responses++
+	a.ResponseBytes += length
+}
+
+// report 输出扫描结果汇总
+func (r *scanResults) report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reportEcho()
+	r.reportSCTP()
+	r.reportDNS()
+	r.reportUDP()
+}
+
+// reportEcho 输出每个主机的存活状态和往返时延统计，调用方需持有锁
+func (r *scanResults) reportEcho() {
+
+	ips := make([]string, 0, len(r.hosts))
+	for ip, h := range r.hosts {
+		if h.EchoSent > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	sort.Strings(ips)
+
+	alive := 0
+	log.Println("主机存活探测结果:")
+	for _, ip := range ips {
+		h := r.hosts[ip]
+		if h.EchoReplies == 0 {
+			log.Printf("  %s 未响应 (发送 %d 个回显请求)", ip, h.EchoSent)
+			continue
+		}
+		alive++
+		avg := h.TotalRTT / time.Duration(h.EchoReplies)
+		log.Printf("  %s 存活 (应答 %d/%d, RTT 最小/平均/最大 = %v/%v/%v)", ip, h.EchoReplies, h.EchoSent, h.MinRTT, avg, h.MaxRTT)
+	}
+	log.Printf("共 %d 个主机存活，%d 个主机未响应。", alive, len(ips)-alive)
+}
+
+// reportSCTP 输出每个主机的SCTP端口状态，调用方需持有锁
+func (r *scanResults) reportSCTP() {
+	ips := make([]string, 0, len(r.hosts))
+	for ip, h := range r.hosts {
+		if len(h.SCTPPorts) > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	sort.Strings(ips)
+
+	counts := make(map[string]int)
+	log.Println("SCTP端口探测结果:")
+	for _, ip := range ips {
+		h := r.hosts[ip]
+		ports := make([]int, 0, len(h.SCTPPorts))
+		for port := range h.SCTPPorts {
+			ports = append(ports, int(port))
+		}
+		sort.Ints(ports)
+		for _, port := range ports {
+			state := h.SCTPPorts[uint16(port)]
+			counts[state]++
+			log.Printf("  %s:%d %s", ip, port, state)
+		}
+	}
+	log.Printf("共 %d 个端口开放，%d 个端口关闭，%d 个端口无响应。", counts[sctpPortOpen], counts[sctpPortClosed], counts[sctpPortNoResponse])
+}
+
+// reportDNS 输出每个主机的DNS响应码、应答数量以及是否为开放解析器，调用方需持有锁
+func (r *scanResults) reportDNS() {
+	ips := make([]string, 0, len(r.hosts))
+	for ip, h := range r.hosts {
+		if h.DNSSent > 0 {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	sort.Strings(ips)
+
+	responding, open := 0, 0
+	log.Println("DNS探测结果:")
+	for _, ip := range ips {
+		h := r.hosts[ip]
+		if len(h.DNSReplies) == 0 {
+			log.Printf("  %s 未响应 (发送 %d 个查询)", ip, h.DNSSent)
+			continue
+		}
+		responding++
+		isOpen := false
+		for _, resp := range h.DNSReplies {
+			state := "非开放解析器"
+			if resp.Open {
+				state = "开放解析器"
+				isOpen = true
+			}
+			log.Printf("  %s:%d %s 响应码 %s, 应答 %d 条, %s", ip, resp.Port, resp.Name, resp.RCode, resp.Answers, state)
+		}
+		if isOpen {
+			open++
+		}
+	}
+	log.Printf("共 %d 个主机响应DNS查询，其中 %d 个为开放解析器，%d 个主机未响应。", responding, open, len(ips)-responding)
+}
+
+// reportUDP 按目标和模板输出UDP探测的带宽放大倍数和报文放大倍数，调用方需持有锁
+// 仅列出有响应的目标，按模板汇总的放大倍数也只统计有响应的目标 (即潜在的反射器)
+func (r *scanResults) reportUDP() {
+	totals := make(map[templateRef]*udpAmplification) // 模板 -> 有响应目标的流量合计
+	probed := make(map[templateRef]int)               // 模板 -> 探测的目标数
+	responders := make(map[templateRef]int)           // 模板 -> 有响应的目标数
+	var ips []string
+	for ip, h := range r.hosts {
+		responded := false
+		for template, a := range h.UDP {
+			probed[template]++
+			total, ok := totals[template]
+			if !ok {
+				total = &udpAmplification{}
+				totals[template] = total
+			}
+			if a.Responses > 0 {
+				total.add(a)
+				responders[template]++
+				responded = true
+			}
+		}
+		if responded {
+			ips = append(ips, ip)
+		}
+	}
+	if len(totals) == 0 {
+		return
+	}
+	sort.Strings(ips)
+
+	log.Println("UDP放大探测结果:")
+	for _, ip := range ips {
+		h := r.hosts[ip]
+		templates := make([]templateRef, 0, len(h.UDP))
+		for template, a := range h.UDP {
+			if a.Responses > 0 {
+				templates = append(templates, template)
+			}
+		}
+		sortTemplateRefs(templates)
+		for _, template := range templates {
+			a := h.UDP[template]
+			bandwidth, packets := a.factors()
+			log.Printf("  %s 模板 %s: 请求 %d 个/%d 字节, 响应 %d 个/%d 字节, 带宽放大 %.1fx, 报文放大 %.1fx",
+				ip, template, a.Probes, a.SentBytes, a.Responses, a.ResponseBytes, bandwidth, packets)
+		}
+	}
+
+	templates := make([]templateRef, 0, len(totals))
+	for template := range totals {
+		templates = append(templates, template)
+	}
+	sortTemplateRefs(templates)
+	log.Println("按模板汇总:")
+	for _, template := range templates {
+		a := totals[template]
+		bandwidth, packets := a.factors()
+		log.Printf("  模板 %s: %d/%d 个目标响应, 请求 %d 个/%d 字节, 响应 %d 个/%d 字节, 带宽放大 %.1fx, 报文放大 %.1fx",
+			template, responders[template], probed[template], a.Probes, a.SentBytes, a.Responses, a.ResponseBytes, bandwidth, packets)
+	}
+	log.Printf("共 %d 个目标响应了UDP探测。", len(ips))
+}
+
+// sortTemplateRefs 按来源文件和序号排序模板
+func sortTemplateRefs(refs []templateRef) {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Source != refs[j].Source {
+			return refs[i].Source < refs[j].Source
+		}
+		return refs[i].Index < refs[j].Index
+	})
+}
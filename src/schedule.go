@@ -0,0 +1,188 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"log"
+	"net"
+	"time"
+)
+
+// hostLimits 保存对单个目标和单个网段的速率限制
+type hostLimits struct {
+	hostPPS    int // 每个目标每秒的报文数，0 表示不限制
+	prefixPPS  int // 每个网段每秒的报文数，0 表示不限制
+	prefixLen4 int // IPv4 网段的前缀长度
+	prefixLen6 int // IPv6 网段的前缀长度
+}
+
+// newHostLimits 创建单目标和单网段速率限制，均未设置时返回nil
+func newHostLimits(hostPPS, prefixPPS, prefixLen4, prefixLen6 int) *hostLimits {
+	if hostPPS <= 0 && prefixPPS <= 0 {
+		return nil
+	}
+	return &hostLimits{hostPPS: hostPPS, prefixPPS: prefixPPS, prefixLen4: prefixLen4, prefixLen6: prefixLen6}
+}
+
+// prefix 返回目标所属网段的网络地址
+func (l *hostLimits) prefix(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.prefixLen4, 32))
+	}
+	return ip.Mask(net.CIDRMask(l.prefixLen6, 128))
+}
+
+// owner 返回负责该目标的发送协程序号
+// 同一目标 (限制网段速率时为同一网段) 的全部探测报文总是由同一协程发送，因此限制无需在协程间同步
+func (l *hostLimits) owner(ip net.IP, workers int) int {
+	if workers == 1 {
+		return 0
+	}
+	key := ip
+	if l.prefixPPS > 0 {
+		key = l.prefix(ip)
+	}
+	h := fnv.New32a()
+	h.Write(key.To16())
+	return int(h.Sum32() % uint32(workers))
+}
+
+// interval 返回每秒 pps 个报文对应的发送间隔，pps 为0时返回0
+func interval(pps int) time.Duration {
+	if pps <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(pps)
+}
+
+// scheduledHost 是调度队列中的一个目标
+type scheduledHost struct {
+	target   net.IP
+	destMAC  net.HardwareAddr
+	prefix   string    // 所属网段，用于查找网段的下一个可发送时间
+	template int       // 下一个要发送的模板序号
+	hostNext time.Time // 该目标的下一个可发送时间
+	ready    time.Time // 该目标和其网段都允许发送的最早时间
+}
+
+// hostQueue 是按最早可发送时间排列的最小堆
+type hostQueue []*scheduledHost
+
+func (q hostQueue) Len() int            { return len(q) }
+func (q hostQueue) Less(i, j int) bool  { return q[i].ready.Before(q[j].ready) }
+func (q hostQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *hostQueue) Push(x interface{}) { *q = append(*q, x.(*scheduledHost)) }
+func (q *hostQueue) Pop() interface{} {
+	old := *q
+	h := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return h
+}
+
+// readyAt 返回目标和其网段都允许发送的最早时间
+func (w *sendWorker) readyAt(h *scheduledHost) time.Time {
+	ready := h.hostNext
+	if next := w.prefixNext[h.prefix]; next.After(ready) {
+		ready = next
+	}
+	return ready
+}
+
+// runScheduled 在单目标和单网段速率限制下发送本协程负责的目标
+// 调度器不再将一个目标的全部模板连续发送，而是在多个目标之间交替: 总是发送最早允许发送的目标，
+// 没有目标可以立即发送时加入新的目标，全部目标都已加入时等待 (同时仍受全局 -pps 和 -bandwidth 限制)
+func (w *sendWorker) runScheduled(targets []net.IP, templates []PacketTemplate, compiled []*compiledTemplate) {
+	hostInterval, prefixInterval := interval(w.limits.hostPPS), interval(w.limits.prefixPPS)
+	var queue hostQueue
+	pending := 0 // 下一个待加入调度队列的目标
+
+	for {
+		now := time.Now()
+		if len(queue) == 0 || queue[0].ready.After(now) {
+			// 先提交已排队的报文，使其发送时间不因解析新目标或等待而推迟
+			w.flush()
+			if h := w.admitHost(targets, &pending); h != nil {
+				heap.Push(&queue, h)
+				continue
+			}
+			if len(queue) == 0 {
+				return
+			}
+			sleepUntil(queue[0].ready)
+			continue
+		}
+
+		h := queue[0]
+		// 同一网段的其他目标可能已用掉网段的配额，重新计算可发送时间
+		if ready := w.readyAt(h); ready.After(now) {
+			h.ready = ready
+			heap.Fix(&queue, 0)
+			continue
+		}
+
+		w.sendProbe(h.target, h.destMAC, &templates[h.template], compiled[h.template])
+		h.template++
+
+		// 消耗目标和网段的配额 (从实际发送时间算起，全局限速可能推迟发送)，发送时间晚于计划时不累积配额
+		now = time.Now()
+		if hostInterval > 0 {
+			h.hostNext = now.Add(hostInterval)
+		}
+		if prefixInterval > 0 {
+			next := w.prefixNext[h.prefix]
+			if next.Before(now) {
+				next = now
+			}
+			w.prefixNext[h.prefix] = next.Add(prefixInterval)
+		}
+
+		if h.template == len(templates) {
+			heap.Pop(&queue)
+			continue
+		}
+		h.ready = w.readyAt(h)
+		heap.Fix(&queue, 0)
+	}
+}
+
+// admitHost 返回下一个由本协程负责且能解析出MAC地址的目标，全部目标都已加入时返回nil
+func (w *sendWorker) admitHost(targets []net.IP, pending *int) *scheduledHost {
+	for *pending < len(targets) {
+		targetIP := targets[*pending]
+		*pending++
+		if w.limits.owner(targetIP, w.count) != w.index {
+			continue
+		}
+		destMAC, err := resolveDestMAC(targetIP)
+		if err != nil {
+			log.Printf("解析目标 IP %s 的 MAC 地址时出错: %v, 跳过此目标。", targetIP.String(), err)
+			continue
+		}
+		h := &scheduledHost{target: targetIP, destMAC: destMAC}
+		if w.limits.prefixPPS > 0 {
+			h.prefix = string(w.limits.prefix(targetIP))
+		}
+		h.ready = w.readyAt(h)
+		return h
+	}
+	return nil
+}
@@ -19,18 +19,28 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/binary"
 	"log"
+	"math/rand"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+)
+
+// SCTP INIT探测使用的源端口范围 (Linux 默认临时端口范围 32768-60999)
+const (
+	sctpSrcPortBase = 32768
+	sctpSrcPortSpan = 28232
 )
 
 // sendPackets 向目标IP发送报文
-func sendPackets(wg *sync.WaitGroup, ifaceName string, srcIP net.IP, targetIPs []net.IP, templates []gopacket.Packet, sentSessions map[SessionKey]struct{}, mu *sync.Mutex, senderDone chan struct{}, captureEnabled bool, pps int) {
+// (目标, 模板) 组合被划分给 workers 个发送协程，每个协程拥有独立的发送接口、模板副本、帧缓冲区和速率配额
+func sendPackets(wg *sync.WaitGroup, ifaceName string, srcIP net.IP, plan []probeGroup, sessions *sessionTable, senderDone chan struct{}, captureEnabled bool, pps int, bandwidth float64, burst int, limits *hostLimits, adaptive *adaptiveRate, stats *captureStats, workers int, vlanIDs []uint16, overrides *headerOverrides, dnsName string, txBackend string, txBatch int, results *scanResults) {
 	defer wg.Done()
 	defer close(senderDone)
 
@@ -40,171 +50,498 @@ func sendPackets(wg *sync.WaitGroup, ifaceName string, srcIP net.IP, targetIPs [
 		log.Fatalf("获取接口 %s 的 MAC 地址时出错: %v", ifaceName, err)
 	}
 
-	// 打开网络接口进行发送
-	handle, err := pcap.OpenLive(ifaceName, 1600, true, pcap.BlockForever)
-	if err != nil {
-		log.Fatalf("打开接口 %s 进行发送时出错: %v", ifaceName, err)
+	totalTargets := 0
+	for _, group := range plan {
+		totalTargets += len(group.targets)
 	}
-	defer handle.Close()
-
-	log.Printf("开始从 %s 向 %d 个目标IP发送报文...", srcIP.String(), len(targetIPs))
 
-	var ticker *time.Ticker
+	// 每个发送协程至少分得每秒1个报文的配额
+	if workers < 1 {
+		workers = 1
+	}
+	if pps > 0 && workers > pps {
+		workers = pps
+	}
+	log.Printf("开始从 %s 向 %d 个目标IP发送报文 (%d 个发送协程)...", srcIP.String(), totalTargets, workers)
 	if pps > 0 {
-		// 计算每个报文的发送间隔
-		packetInterval := time.Second / time.Duration(pps)
-		ticker = time.NewTicker(packetInterval)
-		defer ticker.Stop()
 		log.Printf("发包速率限制为每秒 %d 个报文。", pps)
-	} else {
+	}
+	if bandwidth > 0 {
+		log.Printf("发送带宽限制为 %s。", formatBitRate(bandwidth))
+	}
+	if adaptive != nil {
+		log.Printf("启用自适应速率控制，速率范围为每秒 %.0f-%.0f 个报文。", adaptive.min, adaptive.max)
+	}
+	if pps == 0 && bandwidth == 0 {
 		log.Println("未设置发包速率限制。")
 	}
+	if limits != nil && limits.hostPPS > 0 {
+		log.Printf("每个目标的发包速率限制为每秒 %d 个报文。", limits.hostPPS)
+	}
+	if limits != nil && limits.prefixPPS > 0 {
+		log.Printf("每个网段 (IPv4 /%d, IPv6 /%d) 的发包速率限制为每秒 %d 个报文。", limits.prefixLen4, limits.prefixLen6, limits.prefixPPS)
+	}
 
-	for _, targetIP := range targetIPs {
-		// 解析目标 MAC 地址
-		destMAC, err := resolveDestMAC(targetIP)
+	// ICMP回显请求的标识符基数和DNS查询的事务ID基数，由全部发送协程共用
+	echoIDBase := uint16(rand.Intn(1 << 16))
+	dnsIDBase := uint16(rand.Intn(1 << 16))
+
+	// 设置了单目标或单网段速率限制时，目标按哈希划分给协程，各协程负责的目标数量和可发送时机不均衡，
+	// 平均分配的配额会让部分协程闲置而其他协程受限于自己的份额，因此全部协程共用一个全局令牌桶
+	var sharedPacer *pacer
+
+	var workerWG sync.WaitGroup
+	sendWorkers := make([]*sendWorker, workers)
+	for i := 0; i < workers; i++ {
+		// 打开网络接口进行发送，发送环不可用时后续协程直接使用回退后的后端
+		writer, backend, err := openPacketWriter(txBackend, ifaceName, txBatch)
 		if err != nil {
-			log.Printf("解析目标 IP %s 的 MAC 地址时出错: %v, 跳过此目标。", targetIP.String(), err)
-			continue
+			log.Fatalf("打开接口 %s 进行发送时出错: %v", ifaceName, err)
+		}
+		if i == 0 && backend == txBackendTXRing {
+			log.Printf("使用AF_PACKET发送环发送报文，每批 %d 个。", txBatch)
 		}
+		txBackend = backend
 
-		for _, templatePacket := range templates {
-			// 如果设置了速率限制，则等待下一个滴答
-			if pps > 0 {
-				<-ticker.C
+		// 速率、带宽和突发配额在协程间平均分配，余数分给前面的协程
+		workerPPS := 0
+		if pps > 0 {
+			workerPPS = pps / workers
+			if i < pps%workers {
+				workerPPS++
 			}
+		}
+		workerBurst := 0
+		if burst > 0 {
+			workerBurst = (burst + workers - 1) / workers
+		}
+		batch := 1
+		if backend == txBackendTXRing {
+			batch = txBatch
+		}
 
-			// 从模板创建新报文以进行修改
-			buffer := gopacket.NewSerializeBuffer()
-			options := gopacket.SerializeOptions{
-				FixLengths:       true, // 自动修正长度字段
-				ComputeChecksums: true, // 自动计算校验和
-			}
+		if limits != nil && i == 0 {
+			sharedPacer = newPacer(float64(pps), bandwidth, burst, batch)
+		}
+		workerPacer := sharedPacer
+		if limits == nil {
+			workerPacer = newPacer(float64(workerPPS), bandwidth/float64(workers), workerBurst, batch)
+		}
 
-			// 从模板中提取各层
-			var ip4Layer *layers.IPv4
-			var ip6Layer *layers.IPv6
-			var tcpLayer *layers.TCP
-			var udpLayer *layers.UDP
-
-			for _, layer := range templatePacket.Layers() {
-				switch layerType := layer.LayerType(); layerType {
-				case layers.LayerTypeIPv4:
-					ip4Layer = layer.(*layers.IPv4)
-				case layers.LayerTypeIPv6:
-					ip6Layer = layer.(*layers.IPv6)
-				case layers.LayerTypeTCP:
-					tcpLayer = layer.(*layers.TCP)
-				case layers.LayerTypeUDP:
-					udpLayer = layer.(*layers.UDP)
+		w := &sendWorker{
+			index:          i,
+			count:          workers,
+			writer:         writer,
+			pacer:          workerPacer,
+			limits:         limits,
+			prefixNext:     make(map[string]time.Time),
+			srcIP:          srcIP,
+			srcMAC:         srcMAC,
+			vlanIDs:        vlanIDs,
+			overrides:      overrides,
+			dnsName:        dnsName,
+			captureEnabled: captureEnabled,
+			sessions:       sessions,
+			srcAddr:        addrFromIP(srcIP),
+			results:        results,
+			echoIDBase:     echoIDBase,
+			dnsIDBase:      dnsIDBase,
+		}
+		sendWorkers[i] = w
+		workerWG.Add(1)
+		go w.run(&workerWG, plan)
+	}
+
+	// 定期报告实际发送速率，直到全部发送协程完成
+	start := time.Now()
+	workersDone := make(chan struct{})
+	go func() {
+		workerWG.Wait()
+		close(workersDone)
+	}()
+	ticker := time.NewTicker(sendReportInterval)
+	defer ticker.Stop()
+	var lastPackets, lastBytes uint64
+	lastTime := start
+
+	// 自适应速率控制: 每个窗口汇总发送错误、捕获端丢包和响应比例，调整全部发送协程的速率
+	var adaptiveTick <-chan time.Time
+	var last rateSample
+	lastAdaptive := start
+	if adaptive != nil {
+		adaptiveTicker := time.NewTicker(adaptiveInterval)
+		defer adaptiveTicker.Stop()
+		adaptiveTick = adaptiveTicker.C
+	}
+
+	for running := true; running; {
+		select {
+		case <-workersDone:
+			running = false
+		case now := <-adaptiveTick:
+			cur := rateSample{responses: stats.responses.Load(), dropped: stats.dropped.Load()}
+			cur.sent, _, cur.errors = sentTotals(sendWorkers)
+			sample := rateSample{
+				elapsed:   now.Sub(lastAdaptive),
+				sent:      cur.sent - last.sent,
+				errors:    cur.errors - last.errors,
+				dropped:   cur.dropped - last.dropped,
+				responses: cur.responses - last.responses,
+			}
+			last, lastAdaptive = cur, now
+			if rate := adaptive.rate; adaptive.update(sample) != rate {
+				if sharedPacer != nil {
+					sharedPacer.setRate(adaptive.rate)
+				} else {
+					for _, w := range sendWorkers {
+						w.pacer.setRate(adaptive.rate / float64(len(sendWorkers)))
+					}
 				}
 			}
+		case now := <-ticker.C:
+			packets, bytes, _ := sentTotals(sendWorkers)
+			elapsed := now.Sub(lastTime).Seconds()
+			log.Printf("已发送 %d 个报文，当前速率 %.0f pps, %s。", packets,
+				float64(packets-lastPackets)/elapsed, formatBitRate(float64(bytes-lastBytes)*8/elapsed))
+			lastPackets, lastBytes, lastTime = packets, bytes, now
+		}
+	}
 
-			// 修改IP层
-			if ip4Layer != nil {
-				ip4Layer.SrcIP = srcIP
-				ip4Layer.DstIP = targetIP
-				ip4Layer.Checksum = 0 // gopacket将重新计算
-			} else if ip6Layer != nil {
-				ip6Layer.SrcIP = srcIP
-				ip6Layer.DstIP = targetIP
-			} else {
-				log.Printf("警告: 报文模板没有IPv4或IPv6层，跳过此报文的修改。")
-				continue
+	packets, bytes, _ := sentTotals(sendWorkers)
+	elapsed := time.Since(start)
+	log.Printf("发送器完成所有报文发送: 共 %d 个报文 (%d 字节)，用时 %v，平均速率 %.0f pps, %s。", packets, bytes,
+		elapsed.Round(time.Millisecond), float64(packets)/elapsed.Seconds(), formatBitRate(float64(bytes)*8/elapsed.Seconds()))
+}
+
+// 报告实际发送速率的间隔
+const sendReportInterval = 5 * time.Second
+
+// sentTotals 汇总全部发送协程已发送的报文数、字节数以及发送错误和发送队列已满的次数
+func sentTotals(workers []*sendWorker) (packets, bytes, errors uint64) {
+	for _, w := range workers {
+		packets += w.sentPackets.Load()
+		bytes += w.sentBytes.Load()
+		errors += w.sendErrors.Load() + w.writer.Backpressure()
+	}
+	return packets, bytes, errors
+}
+
+// strideCounter 是在发送协程之间交错分配的计数器: 第 i 个协程 (共 n 个) 依次取得 i, i+n, i+2n...
+// 各协程取得的值互不重复，且无需加锁
+type strideCounter struct {
+	next, step uint64
+}
+
+// take 返回当前值并前进一步
+func (c *strideCounter) take() uint64 {
+	v := c.next
+	c.next += c.step
+	return v
+}
+
+// sendWorker 是一个发送协程，负责每个目标组中连续的一段 (目标, 模板) 组合，
+// 设置了单目标或单网段速率限制时则负责按目标 (或网段) 划分给它的目标
+type sendWorker struct {
+	index, count   int // 协程序号和协程总数
+	writer         packetWriter
+	pacer          *pacer // 本协程的速率配额 (单目标或单网段限速时为全部协程共用的令牌桶)，nil 表示不限制
+	srcIP          net.IP
+	srcMAC         net.HardwareAddr
+	vlanIDs        []uint16
+	overrides      *headerOverrides
+	dnsName        string
+	captureEnabled bool
+	srcAddr        netip.Addr
+	sessions       *sessionTable
+	results        *scanResults
+	echoIDBase     uint16
+	dnsIDBase      uint16
+	limits         *hostLimits // 单目标和单网段的速率限制，nil 表示不限制
+	prefixNext     map[string]time.Time
+	sentPackets    atomic.Uint64 // 已发送的报文数和字节数，由速率报告并发读取
+	sentBytes      atomic.Uint64
+	sendErrors     atomic.Uint64
+
+	// 以下字段仅由本协程使用
+	echoCount, sctpCount, dnsCount, probeCount strideCounter
+	frameBuf                                   []byte
+}
+
+// run 发送本协程负责的全部探测报文
+func (w *sendWorker) run(wg *sync.WaitGroup, plan []probeGroup) {
+	defer wg.Done()
+	defer w.writer.Close()
+
+	// 回显请求、SCTP INIT、DNS查询以及全部探测报文 (用于载荷占位符 {{counter}}) 的计数，
+	// 保证每个探测报文拥有唯一的标识符/序列号组合、源端口和事务ID
+	newCounter := func() strideCounter {
+		return strideCounter{next: uint64(w.index), step: uint64(w.count)}
+	}
+	w.echoCount, w.sctpCount, w.dnsCount, w.probeCount = newCounter(), newCounter(), newCounter(), newCounter()
+	// 预编译模板的帧缓冲区，在所有探测报文之间复用
+	w.frameBuf = make([]byte, 0, 65536)
+
+	// 按探测计划依次向每个目标组发送其对应的模板
+	for _, group := range plan {
+		if len(group.targets) == 0 || len(group.templates) == 0 {
+			continue
+		}
+		// 模板的层对象在发送时会被修改，每个协程使用独立的副本
+		templates := cloneTemplates(group.templates)
+
+		// 预编译模板: 每个探测报文只需复制并修补字段，无法预编译的模板逐个重新序列化
+		compiled := make([]*compiledTemplate, len(templates))
+		compiledCount := 0
+		for i := range templates {
+			compiled[i] = compileTemplate(&templates[i], w.srcIP, w.srcMAC, w.vlanIDs, w.overrides, w.dnsName)
+			if compiled[i] != nil {
+				compiledCount++
 			}
+		}
+		if w.index == 0 {
+			log.Printf("已预编译 %d/%d 个模板。", compiledCount, len(templates))
+		}
 
-			// 关联网络层以计算校验和，并重置校验和字段
-			if tcpLayer != nil {
-				if ip4Layer != nil {
-					tcpLayer.SetNetworkLayerForChecksum(ip4Layer)
-				} else if ip6Layer != nil {
-					tcpLayer.SetNetworkLayerForChecksum(ip6Layer)
-				}
-				tcpLayer.Checksum = 0 // 强制gopacket重新计算校验和
-			} else if udpLayer != nil {
-				if ip4Layer != nil {
-					udpLayer.SetNetworkLayerForChecksum(ip4Layer)
-				} else if ip6Layer != nil {
-					udpLayer.SetNetworkLayerForChecksum(ip6Layer)
+		// 设置了单目标或单网段速率限制时，由调度器在多个目标之间交替发送
+		if w.limits != nil {
+			w.runScheduled(group.targets, templates, compiled)
+			continue
+		}
+
+		// 本协程负责第 start 到 end-1 个 (目标, 模板) 组合，组合按目标排列，同一目标的模板尽量由同一协程发送
+		total := len(group.targets) * len(templates)
+		start, end := w.index*total/w.count, (w.index+1)*total/w.count
+
+		var destMAC net.HardwareAddr
+		lastTarget := -1
+		for k := start; k < end; k++ {
+			targetIP, i := group.targets[k/len(templates)], k%len(templates)
+
+			// 解析目标 MAC 地址
+			if k/len(templates) != lastTarget {
+				lastTarget = k / len(templates)
+				var err error
+				destMAC, err = resolveDestMAC(targetIP)
+				if err != nil {
+					log.Printf("解析目标 IP %s 的 MAC 地址时出错: %v, 跳过此目标。", targetIP.String(), err)
+					// 跳过此目标的其余模板
+					k = (lastTarget+1)*len(templates) - 1
+					continue
 				}
-				udpLayer.Checksum = 0 // 强制gopacket重新计算校验和
 			}
+			w.sendProbe(targetIP, destMAC, &templates[i], compiled[i])
+		}
+	}
+}
 
-			// 构建新的以太网层
-			ethLayer := &layers.Ethernet{
-				SrcMAC: srcMAC,
-				DstMAC: destMAC,
-				EthernetType: layers.EthernetTypeIPv4, // 假设是IPv4，如果需要IPv6，则需要根据实际情况判断
-			}
-			if ip6Layer != nil {
-				ethLayer.EthernetType = layers.EthernetTypeIPv6
-			}
+// flush 提交已排队的报文，限速器在等待之前调用
+func (w *sendWorker) flush() {
+	if err := w.writer.Flush(); err != nil {
+		w.sendErrors.Add(1)
+		log.Printf("发送报文时出错: %v", err)
+	}
+}
 
-			// 重新序列化报文
-			// 构建要序列化的层列表
-			var layersToSerialize []gopacket.SerializableLayer
-			layersToSerialize = append(layersToSerialize, ethLayer)
-			if ip4Layer != nil {
-				layersToSerialize = append(layersToSerialize, ip4Layer)
-			}
-			if ip6Layer != nil {
-				layersToSerialize = append(layersToSerialize, ip6Layer)
-			}
-			if tcpLayer != nil {
-				layersToSerialize = append(layersToSerialize, tcpLayer)
-			}
-			if udpLayer != nil {
-				layersToSerialize = append(layersToSerialize, udpLayer)
-			}
+// sendProbe 由模板构建发往目标的一个探测报文，登记会话后发送
+// compiled 为nil时逐个报文重新序列化模板
+func (w *sendWorker) sendProbe(targetIP net.IP, destMAC net.HardwareAddr, template *PacketTemplate, compiled *compiledTemplate) {
+	// 从模板中提取链路层之后的全部层，并替换最外层IP地址 (仅用于无法预编译的模板)
+	var probe *probeLayers
+	var summary probeSummary
+	var err error
+	if compiled != nil {
+		if err := compiled.checkTarget(w.srcIP, targetIP); err != nil {
+			log.Printf("警告: 模板 %s: %v，跳过此报文。", template.name(), err)
+			return
+		}
+		summary = compiled.summary
+	} else {
+		probe, err = extractProbeLayers(template.Packet)
+		if err != nil {
+			log.Printf("警告: 模板 %s: %v，跳过此报文。", template.name(), err)
+			return
+		}
+		if err := probe.rewriteAddresses(w.srcIP, targetIP); err != nil {
+			log.Printf("警告: 模板 %s: %v，跳过此报文。", template.name(), err)
+			return
+		}
+		probe.applyOverrides(w.overrides)
+		summary = probe.summary()
+	}
 
-			// 添加应用层载荷（如果存在）
-			if appLayer := templatePacket.ApplicationLayer(); appLayer != nil {
-				layersToSerialize = append(layersToSerialize, gopacket.Payload(appLayer.Payload()))
-			}
+	// 分配探测报文独有的字段: 回显标识符/序列号、TCP序列号和时间戳、SCTP源端口和发起标签、DNS事务ID
+	// TCP探测使用随机的初始序列号和时间戳，避免所有探测报文除地址外完全相同
+	var id probeIdentity
+	if summary.echo {
+		n := w.echoCount.take()
+		id.echoID, id.echoSeq = w.echoIDBase+uint16(n>>16), uint16(n)
+	}
+	if summary.tcp {
+		id.tcpSeq, id.tcpAck, id.tsval, id.tsecr = rand.Uint32(), rand.Uint32(), rand.Uint32(), rand.Uint32()
+	}
+	if summary.sctpInit {
+		id.sctpPort = sctpSrcPortBase + uint16(w.sctpCount.take()%sctpSrcPortSpan)
+		id.sctpTag = rand.Uint32() | 1 // 发起标签不能为0
+	}
+	if summary.dns {
+		id.dnsID = w.dnsIDBase + uint16(w.dnsCount.take())
+	}
 
-			// 重新序列化报文
-			err = gopacket.SerializeLayers(buffer, options, layersToSerialize...)
-			if err != nil {
-				log.Printf("序列化报文时出错: %v", err)
-				continue
-			}
+	var frame []byte
+	if compiled != nil {
+		frame = compiled.build(w.frameBuf, destMAC, targetIP, &id, w.overrides)
+		if summary.sctpInit {
+			summary.srcPort = id.sctpPort
+		}
+		w.probeCount.take()
+	} else {
+		probe.applyIdentity(&id)
 
-			// 如果启用了捕获功能，则存储会话键
-			if captureEnabled {
-				key := SessionKey{
-					SrcIP: srcIP.String(),
-					DstIP: targetIP.String(),
-				}
-				if tcpLayer != nil {
-					key.SrcPort = uint16(tcpLayer.SrcPort)
-					key.DstPort = uint16(tcpLayer.DstPort)
-					key.Proto = layers.IPProtocolTCP
-				} else if udpLayer != nil {
-					key.SrcPort = uint16(udpLayer.SrcPort)
-					key.DstPort = uint16(udpLayer.DstPort)
-					key.Proto = layers.IPProtocolUDP
-				} else if ip4Layer != nil {
-					key.Proto = ip4Layer.Protocol
-				} else if ip6Layer != nil {
-					key.Proto = ip6Layer.NextHeader
-				}
+		// 替换载荷中的占位符 (目标地址、端口、随机数、计数等)
+		srcPort, dstPort := probe.ports()
+		vars := &payloadVars{
+			targetIP:   targetIP,
+			srcIP:      w.srcIP,
+			targetPort: dstPort,
+			srcPort:    srcPort,
+			random:     rand.Uint32(),
+			counter:    w.probeCount.take(),
+		}
+		probe.substitutePayload(vars)
+		// DNS查询可按目标替换查询名称
+		if probe.dns != nil && w.dnsName != "" {
+			probe.setDNSIdentity(id.dnsID, string(substitutePlaceholders([]byte(w.dnsName), vars)))
+		}
 
-				mu.Lock()
-				sentSessions[key] = struct{}{}
-				mu.Unlock()
-			}
+		// 重新序列化报文: 以太网层、VLAN标签以及模板中最外层IP之后的全部层
+		buffer := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{
+			FixLengths:       true, // 自动修正长度字段
+			ComputeChecksums: true, // 自动计算校验和
+		}
+		err = gopacket.SerializeLayers(buffer, options, probeFrameLayers(probe, template.Packet, w.srcMAC, destMAC, w.vlanIDs)...)
+		if err != nil {
+			log.Printf("序列化模板 %s 的报文时出错: %v", template.name(), err)
+			return
+		}
+		frame = buffer.Bytes()
+		summary = probe.summary()
+	}
+
+	// 如果设置了速率或带宽限制，则等待令牌 (在登记会话之前，使发送时间准确)
+	if w.pacer != nil {
+		w.pacer.wait(len(frame), w.flush)
+	}
+
+	// 如果启用了捕获功能，则存储会话键
+	if w.captureEnabled {
+		w.registerSession(targetIP, template, summary, &id, frame)
+	}
+
+	// 发送报文
+	if err := w.writer.WritePacketData(frame); err != nil {
+		w.sendErrors.Add(1)
+		log.Printf("发送报文时出错: %v", err)
+		return
+	}
+	w.sentPackets.Add(1)
+	w.sentBytes.Add(uint64(len(frame)))
+}
+
+// registerSession 在发送前登记探测报文的会话键并更新统计，供监听器匹配响应
+func (w *sendWorker) registerSession(targetIP net.IP, template *PacketTemplate, summary probeSummary, id *probeIdentity, frame []byte) {
+	key := SessionKey{
+		SrcIP:   w.srcAddr,
+		DstIP:   addrFromIP(targetIP),
+		Proto:   summary.proto,
+		SrcPort: summary.srcPort,
+		DstPort: summary.dstPort,
+	}
+	if summary.echo {
+		key.SrcPort, key.DstPort = id.echoID, id.echoSeq
+	}
+
+	info := SessionInfo{SentAt: time.Now(), SCTPTag: id.sctpTag, Template: template.ref(), TemplateIndex: template.Index}
+	if summary.tcp {
+		info.TCPSeq = id.tcpSeq
+		info.TCPLen = summary.tcpLen
+		info.TCPAck = id.tcpAck
+		info.TCPAckSet = summary.tcpAckSet
+	}
+	if summary.dns {
+		info.DNSQuery = true
+		info.DNSID = id.dnsID
+	}
+	w.sessions.store(key, info)
+	if summary.echo {
+		w.results.recordEchoRequest(targetIP.String())
+	}
+	if summary.sctpInit {
+		w.results.recordSCTPInit(targetIP.String(), key.DstPort)
+	}
+	if summary.dns {
+		w.results.recordDNSQuery(targetIP.String())
+	}
+	if summary.proto == layers.IPProtocolUDP {
+		w.results.recordUDPProbe(targetIP.String(), template.ref(), frameIPLength(frame))
+	}
+}
+
+// cloneTemplates 从模板的原始字节重新解码出一组独立的模板，供各发送协程分别修改
+func cloneTemplates(templates []PacketTemplate) []PacketTemplate {
+	clones := make([]PacketTemplate, len(templates))
+	for i, t := range templates {
+		clones[i] = t
+		if first := t.Packet.Layers(); len(first) > 0 {
+			clones[i].Packet = gopacket.NewPacket(t.Packet.Data(), first[0].LayerType(), gopacket.Default)
+		}
+	}
+	return clones
+}
+
+// probeFrameLayers 构建要序列化的层列表: 以太网层、VLAN标签以及模板中最外层IP之后的全部层
+// VLAN标签优先使用 -vlan 指定的标签，否则保留模板自带的标签
+func probeFrameLayers(probe *probeLayers, templatePacket gopacket.Packet, srcMAC, dstMAC net.HardwareAddr, vlanIDs []uint16) []gopacket.SerializableLayer {
+	ethLayer := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       dstMAC,
+		EthernetType: probe.ethernetType(),
+	}
+
+	var vlanLayers []*layers.Dot1Q
+	if len(vlanIDs) > 0 {
+		vlanLayers = buildVLANLayers(ethLayer, vlanIDs, ethLayer.EthernetType)
+	} else {
+		vlanLayers = reuseTemplateVLANLayers(ethLayer, templatePacket, probe.vlans, ethLayer.EthernetType)
+	}
+
+	layersToSerialize := []gopacket.SerializableLayer{ethLayer}
+	for _, vlanLayer := range vlanLayers {
+		layersToSerialize = append(layersToSerialize, vlanLayer)
+	}
+	return append(layersToSerialize, probe.stack...)
+}
 
-			// 发送报文
-			if err := handle.WritePacketData(buffer.Bytes()); err != nil {
-				log.Printf("发送报文时出错: %v", err)
-			} else {
-				// log.Printf("已从 %s 发送报文到 %s", srcIP.String(), targetIP.String())
+// frameIPLength 返回以太网帧中最外层IP报文的长度 (不含以太网头、VLAN标签和填充)
+func frameIPLength(frame []byte) int {
+	offset := 12
+	for offset+2 <= len(frame) {
+		switch layers.EthernetType(binary.BigEndian.Uint16(frame[offset:])) {
+		case layers.EthernetTypeDot1Q, layers.EthernetTypeQinQ:
+			offset += 4
+		case layers.EthernetTypeIPv4:
+			if offset+6 <= len(frame) {
+				return int(binary.BigEndian.Uint16(frame[offset+4:]))
 			}
-			// 如果未设置速率限制，则保留小延迟以避免网络过载
-			if pps == 0 {
-				time.Sleep(10 * time.Millisecond)
+			return 0
+		case layers.EthernetTypeIPv6:
+			if offset+8 <= len(frame) {
+				return 40 + int(binary.BigEndian.Uint16(frame[offset+6:]))
 			}
+			return 0
+		default:
+			return 0
 		}
 	}
-	log.Println("发送器完成所有报文发送。")
+	return 0
 }
@@ -19,14 +19,169 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
 	"github.com/google/gopacket/layers"
 )
 
 // SessionKey 表示用于跟踪已发送报文的5元组
+// 对于ICMP回显报文，SrcPort 和 DstPort 分别保存标识符和序列号
 type SessionKey struct {
-	SrcIP   string
-	DstIP   string
+	SrcIP   netip.Addr
+	DstIP   netip.Addr
 	SrcPort uint16
 	DstPort uint16
 	Proto   layers.IPProtocol
 }
+
+// SessionInfo 记录已发送探测报文的附加信息
+type SessionInfo struct {
+	SentAt        time.Time     // 报文发送时间，用于计算往返时延
+	SCTPTag       uint32        // SCTP INIT的发起标签，用于校验响应的验证标签
+	Template      templateRef   // 探测报文所用模板的唯一标识，用于按模板汇总结果
+	TemplateIndex int           // 探测报文所用模板在源文件中的序号
+	Attempts      int           // 响应窗口内以同一会话键发送的次数 (从1开始)
+	Earlier       []SessionInfo // 响应窗口内以同一会话键更早发送的探测报文 (从早到晚)，响应可能对应其中任何一个
+
+	TCPSeq    uint32 // TCP探测的初始序列号
+	TCPLen    uint32 // TCP探测占用的序列号空间，对端的确认号应落在 [TCPSeq, TCPSeq+TCPLen] 范围内
+	TCPAck    uint32 // TCP探测的确认号，对端以不带ACK的RST响应时以此作为序列号
+	TCPAckSet bool   // TCP探测是否置位了ACK标志
+
+	DNSQuery bool   // 探测报文是否为DNS查询
+	DNSID    uint16 // DNS查询的事务ID，响应必须携带相同的ID
+}
+
+// 同一会话键保留的最多发送次数，更早的探测报文不再参与响应匹配
+const maxSessionAttempts = 16
+
+// 会话表的分片数量，发送协程和监听器按会话键分散到不同分片，减少锁竞争
+const sessionShards = 64
+
+// sessionTable 是按会话键分片的已发送探测报文表，会话在响应窗口之后过期
+// 每个分片保存当前和上一代两个map，每经过一个响应窗口轮换一次并丢弃更早的一代，
+// 因此过期无需扫描整个表，内存占用不超过两个响应窗口内发送的探测报文
+// 分片使用互斥锁而不是无锁结构: 登记会话要读出同一会话键之前的发送记录再写回，轮换要同时替换两代map，
+// 这些多步更新在锁内最简单可靠；锁只在单个分片内持有且不涉及系统调用，64个分片使发送协程和监听器很少争用同一把锁
+type sessionTable struct {
+	ttl    time.Duration
+	shards [sessionShards]sessionShard
+}
+
+// sessionShard 是会话表的一个分片
+type sessionShard struct {
+	mu       sync.Mutex
+	current  map[SessionKey]SessionInfo
+	previous map[SessionKey]SessionInfo
+	rotated  time.Time // current 开始使用的时间
+}
+
+// newSessionTable 创建会话表，会话在 ttl 之后过期
+func newSessionTable(ttl time.Duration) *sessionTable {
+	t := &sessionTable{ttl: ttl}
+	now := time.Now()
+	for i := range t.shards {
+		t.shards[i].current = make(map[SessionKey]SessionInfo)
+		t.shards[i].rotated = now
+	}
+	return t
+}
+
+// shard 返回会话键所在的分片 (按目标地址、端口和协议做FNV-1a哈希)
+func (t *sessionTable) shard(key SessionKey) *sessionShard {
+	h := uint32(2166136261)
+	addr := key.DstIP.As16()
+	for _, b := range addr {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	for _, b := range [...]byte{byte(key.SrcPort >> 8), byte(key.SrcPort), byte(key.DstPort >> 8), byte(key.DstPort), byte(key.Proto)} {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	return &t.shards[h%sessionShards]
+}
+
+// rotate 在当前一代使用超过一个响应窗口时轮换，调用方需持有分片的锁
+func (s *sessionShard) rotate(now time.Time, ttl time.Duration) {
+	if now.Sub(s.rotated) < ttl {
+		return
+	}
+	if now.Sub(s.rotated) >= 2*ttl {
+		// 两个响应窗口内没有访问，两代会话都已过期
+		s.previous = nil
+	} else {
+		s.previous = s.current
+	}
+	s.current = make(map[SessionKey]SessionInfo)
+	s.rotated = now
+}
+
+// get 查找未过期的会话，调用方需持有分片的锁
+// 更早发送的探测报文中已过期的不再返回
+func (s *sessionShard) get(key SessionKey, now time.Time, ttl time.Duration) (SessionInfo, bool) {
+	info, ok := s.current[key]
+	if !ok {
+		info, ok = s.previous[key]
+	}
+	if !ok || now.Sub(info.SentAt) > ttl {
+		return SessionInfo{}, false
+	}
+	for len(info.Earlier) > 0 && now.Sub(info.Earlier[0].SentAt) > ttl {
+		info.Earlier = info.Earlier[1:]
+	}
+	return info, true
+}
+
+// store 登记一个已发送的探测报文，同一会话键在响应窗口内再次发送时累加发送次数，
+// 并保留之前各次发送的探测标识 (序列号、事务ID等)，使较早探测报文的响应仍能匹配
+func (t *sessionTable) store(key SessionKey, info SessionInfo) {
+	s := t.shard(key)
+	s.mu.Lock()
+	s.rotate(info.SentAt, t.ttl)
+	info.Attempts = 1
+	info.Earlier = nil
+	if old, ok := s.get(key, info.SentAt, t.ttl); ok {
+		info.Attempts = old.Attempts + 1
+		earlier := old.Earlier
+		if len(earlier) > maxSessionAttempts-2 {
+			earlier = earlier[len(earlier)-(maxSessionAttempts-2):]
+		}
+		info.Earlier = make([]SessionInfo, 0, len(earlier)+1)
+		info.Earlier = append(info.Earlier, earlier...)
+		old.Earlier = nil
+		info.Earlier = append(info.Earlier, old)
+	}
+	s.current[key] = info
+	s.mu.Unlock()
+}
+
+// match 从最近一次发送开始依次检查响应窗口内以该会话键发送的探测报文，返回第一个被 accept 接受的
+func (info *SessionInfo) match(accept func(*SessionInfo) bool) (SessionInfo, bool) {
+	if accept(info) {
+		return *info, true
+	}
+	for i := len(info.Earlier) - 1; i >= 0; i-- {
+		if accept(&info.Earlier[i]) {
+			return info.Earlier[i], true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// lookup 查找与响应对应的未过期会话
+func (t *sessionTable) lookup(key SessionKey) (SessionInfo, bool) {
+	now := time.Now()
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(now, t.ttl)
+	return s.get(key, now, t.ttl)
+}
+
+// addrFromIP 将 net.IP 转换为 netip.Addr，IPv4映射的IPv6地址转换为IPv4地址
+func addrFromIP(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
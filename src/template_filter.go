@@ -0,0 +1,110 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// indexRange 表示一个闭区间的报文序号范围
+type indexRange struct {
+	start, end int
+}
+
+// parseIndexSpec 解析模板序号规范，支持逗号分隔的单个序号和范围 (例如: 1,3,5-9)
+func parseIndexSpec(spec string) ([]indexRange, error) {
+	var ranges []indexRange
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		startStr, endStr := s, s
+		if i := strings.Index(s, "-"); i >= 0 {
+			startStr, endStr = s[:i], s[i+1:]
+		}
+		start, err1 := strconv.Atoi(strings.TrimSpace(startStr))
+		end, err2 := strconv.Atoi(strings.TrimSpace(endStr))
+		if err1 != nil || err2 != nil || start < 1 || end < start {
+			return nil, fmt.Errorf("无效的模板序号范围: %s", s)
+		}
+		ranges = append(ranges, indexRange{start, end})
+	}
+	return ranges, nil
+}
+
+// containsIndex 判断序号是否落在任一范围内
+func containsIndex(ranges []indexRange, index int) bool {
+	for _, r := range ranges {
+		if index >= r.start && index <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTemplates 按序号范围和BPF过滤表达式筛选模板
+// BPF表达式按每个模板自身的链路类型离线编译和匹配，序号为报文在源文件中的序号 (从1开始)
+func selectTemplates(templates []PacketTemplate, filterExpr, indexSpec string) ([]PacketTemplate, []SkippedPacket, error) {
+	var ranges []indexRange
+	if indexSpec != "" {
+		var err error
+		ranges, err = parseIndexSpec(indexSpec)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	filters := make(map[layers.LinkType]*pcap.BPF)
+	var selected []PacketTemplate
+	var skipped []SkippedPacket
+	for _, template := range templates {
+		if ranges != nil && !containsIndex(ranges, template.Index) {
+			skipped = append(skipped, SkippedPacket{Index: template.Index, Reason: "不在 -template-index 范围内"})
+			continue
+		}
+		if filterExpr != "" {
+			bpf, ok := filters[template.LinkType]
+			if !ok {
+				var err error
+				bpf, err = pcap.NewBPF(template.LinkType, 65535, filterExpr)
+				if err != nil {
+					return nil, nil, fmt.Errorf("编译模板过滤器 \"%s\" (链路类型 %s) 时出错: %w", filterExpr, template.LinkType, err)
+				}
+				filters[template.LinkType] = bpf
+			}
+			if !bpf.Matches(template.Packet.Metadata().CaptureInfo, template.Packet.Data()) {
+				skipped = append(skipped, SkippedPacket{Index: template.Index, Reason: "不匹配 -template-filter"})
+				continue
+			}
+		}
+		selected = append(selected, template)
+	}
+
+	if len(skipped) > 0 {
+		log.Printf("模板筛选: 保留 %d 个模板，跳过 %d 个不匹配的模板。", len(selected), len(skipped))
+	}
+	return selected, skipped, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIndexSpec(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    []indexRange
+		wantErr bool
+	}{
+		{spec: "3", want: []indexRange{{3, 3}}},
+		{spec: "1, 3-4", want: []indexRange{{1, 1}, {3, 4}}},
+		{spec: "2-2", want: []indexRange{{2, 2}}},
+		// 重复的序号和重叠的范围原样保留，containsIndex 只判断是否落在任一范围内
+		{spec: "1,1,1-2", want: []indexRange{{1, 1}, {1, 1}, {1, 2}}},
+		{spec: "1,,2,", want: []indexRange{{1, 1}, {2, 2}}},
+		{spec: "1-", wantErr: true},
+		{spec: "-3", wantErr: true},
+		{spec: "5-3", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "0-2", wantErr: true},
+		{spec: "a", wantErr: true},
+		{spec: "1-2-3", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseIndexSpec(tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseIndexSpec(%q) = %v，期望返回错误", tc.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIndexSpec(%q): %v", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseIndexSpec(%q) = %v，期望 %v", tc.spec, got, tc.want)
+		}
+	}
+
+	ranges, _ := parseIndexSpec("1,1,4-6")
+	for index, want := range map[int]bool{1: true, 2: false, 4: true, 6: true, 7: false} {
+		if got := containsIndex(ranges, index); got != want {
+			t.Errorf("containsIndex(%v, %d) = %v，期望 %v", ranges, index, got, want)
+		}
+	}
+}
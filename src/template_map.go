@@ -0,0 +1,127 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// templateMapEntry 将一组目标与一组模板关联
+// 未指定 pcap 和 template_spec 时，使用命令行 -pcap/-template-spec 加载的模板
+type templateMapEntry struct {
+	Targets        string `json:"targets"`         // 目标规范，格式与 -target 相同
+	Pcap           string `json:"pcap"`            // 模板pcap文件，相对路径相对于映射文件所在目录
+	TemplateSpec   string `json:"template_spec"`   // 模板规范文件，相对路径相对于映射文件所在目录
+	TemplateIndex  string `json:"template_index"`  // 模板序号范围，格式与 -template-index 相同
+	TemplateFilter string `json:"template_filter"` // 模板BPF过滤表达式，格式与 -template-filter 相同
+}
+
+// probeGroup 表示一组目标及发送给它们的模板
+type probeGroup struct {
+	targets   []net.IP
+	templates []PacketTemplate
+}
+
+// loadTemplateMap 读取模板映射文件，为每个条目解析目标并加载对应的模板
+func loadTemplateMap(filename string, defaults []PacketTemplate, truncatedMode string) ([]probeGroup, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("读取模板映射文件时出错: %w", err)
+	}
+
+	var entries []templateMapEntry
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("解析模板映射文件 %s 时出错: %w", filename, err)
+	}
+
+	baseDir := filepath.Dir(filename)
+	var groups []probeGroup
+	for i, entry := range entries {
+		targets, err := parseTargetSpec(entry.Targets)
+		if err != nil {
+			return nil, fmt.Errorf("模板映射 #%d: 解析目标规范时出错: %w", i+1, err)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("模板映射 #%d: 未指定任何目标", i+1)
+		}
+
+		// 序号范围和过滤表达式作用于条目的pcap模板；未指定pcap时作用于模板规范或命令行提供的模板
+		var templates []PacketTemplate
+		switch {
+		case entry.Pcap != "":
+			templates, _, err = loadTemplates(resolvePath(baseDir, entry.Pcap), resolvePath(baseDir, entry.TemplateSpec),
+				entry.TemplateFilter, entry.TemplateIndex, truncatedMode)
+		case entry.TemplateSpec != "":
+			if templates, err = readTemplateSpecs(resolvePath(baseDir, entry.TemplateSpec)); err == nil {
+				templates, _, err = selectTemplates(templates, entry.TemplateFilter, entry.TemplateIndex)
+			}
+		default:
+			if len(defaults) == 0 {
+				return nil, fmt.Errorf("模板映射 #%d: 未指定 pcap 或 template_spec，且命令行未提供模板", i+1)
+			}
+			templates, err = selectFirstSource(defaults, entry.TemplateFilter, entry.TemplateIndex)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("模板映射 #%d: %w", i+1, err)
+		}
+		if len(templates) == 0 {
+			return nil, fmt.Errorf("模板映射 #%d: 没有可用的模板", i+1)
+		}
+
+		names := make([]string, len(templates))
+		for j := range templates {
+			names[j] = templates[j].name()
+		}
+		log.Printf("模板映射 #%d: %d 个目标使用 %d 个模板: %s", i+1, len(targets), len(templates), strings.Join(names, ", "))
+		groups = append(groups, probeGroup{targets: targets, templates: templates})
+	}
+	return groups, nil
+}
+
+// selectFirstSource 按序号范围和过滤表达式筛选第一个来源文件的模板，其他来源的模板原样保留
+// 命令行模板可能同时来自pcap文件和模板规范文件，两者的序号都从1开始；与 loadTemplates 相同，
+// 筛选只作用于pcap模板 (未提供pcap时为模板规范中的模板)，避免同一序号同时选中两个文件中的模板
+func selectFirstSource(templates []PacketTemplate, filterExpr, indexSpec string) ([]PacketTemplate, error) {
+	n := 0
+	for n < len(templates) && templates[n].Source == templates[0].Source {
+		n++
+	}
+	selected, _, err := selectTemplates(templates[:n], filterExpr, indexSpec)
+	if err != nil {
+		return nil, err
+	}
+	return append(selected, templates[n:]...), nil
+}
+
+// resolvePath 将相对路径解析为相对于 baseDir 的路径，空路径保持为空
+func resolvePath(baseDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
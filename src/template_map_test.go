@@ -0,0 +1,59 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSelectFirstSourceKeepsOtherSources(t *testing.T) {
+	// 命令行模板: pcap文件中的3个模板，之后是模板规范中的2个模板，序号都从1开始
+	base := testTemplate(t, testIPv4(layers.IPProtocolTCP), testTCP(false))
+	var defaults []PacketTemplate
+	for i := 1; i <= 3; i++ {
+		tmpl := base
+		tmpl.Source, tmpl.Index = "capture.pcapng", i
+		defaults = append(defaults, tmpl)
+	}
+	for i := 1; i <= 2; i++ {
+		tmpl := base
+		tmpl.Source, tmpl.Index = "probes.yaml", i
+		defaults = append(defaults, tmpl)
+	}
+
+	selected, err := selectFirstSource(defaults, "", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []templateRef
+	for i := range selected {
+		got = append(got, selected[i].ref())
+	}
+	want := []templateRef{{Source: "capture.pcapng", Index: 2}, {Source: "probes.yaml", Index: 1}, {Source: "probes.yaml", Index: 2}}
+	if len(got) != len(want) {
+		t.Fatalf("选中的模板为 %v，期望 %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("选中的模板为 %v，期望 %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gopkg.in/yaml.v3"
+)
+
+// templateSpec 描述一个声明式报文模板
+type templateSpec struct {
+	Label   string       `json:"label" yaml:"label"`
+	Layers  []layerSpec  `json:"layers" yaml:"layers"`
+	Payload *payloadSpec `json:"payload" yaml:"payload"`
+}
+
+// layerSpec 描述模板中的一层及其字段，Type 决定哪些字段生效
+// 支持的类型: ipv4, ipv6, tcp, udp, icmpv4, icmpv6, sctp
+type layerSpec struct {
+	Type string `json:"type" yaml:"type"`
+
+	// IPv4 / IPv6
+	TTL       uint8  `json:"ttl" yaml:"ttl"`               // IPv4 TTL 或 IPv6 跳数限制，默认 64
+	TOS       uint8  `json:"tos" yaml:"tos"`               // IPv4 TOS 或 IPv6 流量类别
+	ID        uint16 `json:"id" yaml:"id"`                 // IPv4 标识，或 ICMP 回显标识符
+	DF        bool   `json:"df" yaml:"df"`                 // IPv4 不分片标志
+	FlowLabel uint32 `json:"flow_label" yaml:"flow_label"` // IPv6 流标签
+
+	// TCP / UDP / SCTP
+	SrcPort uint16      `json:"src_port" yaml:"src_port"` // 为0时随机选择临时端口
+	DstPort uint16      `json:"dst_port" yaml:"dst_port"`
+	Flags   string      `json:"flags" yaml:"flags"` // TCP 标志位，逗号分隔 (例如: SYN 或 SYN,ACK)
+	Seq     uint32      `json:"seq" yaml:"seq"`     // TCP 序列号或 ICMP 回显序列号
+	Ack     uint32      `json:"ack" yaml:"ack"`
+	Window  uint16      `json:"window" yaml:"window"`   // TCP 窗口，默认 64240
+	Options []tcpOption `json:"options" yaml:"options"` // TCP 选项
+	Chunk   string      `json:"chunk" yaml:"chunk"`     // SCTP 块类型，目前支持 init
+
+	// ICMPv4 / ICMPv6
+	ICMPType uint8 `json:"icmp_type" yaml:"icmp_type"`
+	ICMPCode uint8 `json:"icmp_code" yaml:"icmp_code"`
+}
+
+// tcpOption 描述一个TCP选项
+// Kind 支持 mss, wscale, sack_permitted, timestamps, nop, eol，或以数字表示的其他选项 (配合 Data 使用)
+type tcpOption struct {
+	Kind  string `json:"kind" yaml:"kind"`
+	Value uint32 `json:"value" yaml:"value"` // mss 和 wscale 的取值
+	TSval uint32 `json:"tsval" yaml:"tsval"`
+	TSecr uint32 `json:"tsecr" yaml:"tsecr"`
+	Data  string `json:"data" yaml:"data"` // 其他选项的十六进制数据
+}
+
+// payloadSpec 描述应用层载荷，三种来源只能指定一种
+type payloadSpec struct {
+	Hex    string `json:"hex" yaml:"hex"`
+	String string `json:"string" yaml:"string"`
+	File   string `json:"file" yaml:"file"` // 相对路径相对于模板规范文件所在目录
+}
+
+// readTemplateSpecs 读取JSON或YAML格式 (按扩展名 .yaml/.yml 区分) 的模板规范文件，并编译为与pcap模板相同的结构
+func readTemplateSpecs(filename string) ([]PacketTemplate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("读取模板规范文件时出错: %w", err)
+	}
+
+	var specs []templateSpec
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&specs)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&specs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析模板规范文件 %s 时出错: %w", filename, err)
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var templates []PacketTemplate
+	for i, spec := range specs {
+		packet, err := compileTemplateSpec(spec, filepath.Dir(filename), rng)
+		if err != nil {
+			return nil, fmt.Errorf("编译模板规范 #%d 时出错: %w", i+1, err)
+		}
+		templates = append(templates, PacketTemplate{
+			Packet:   packet,
+			Index:    i + 1,
+			Label:    spec.Label,
+			LinkType: layers.LinkTypeRaw,
+			Source:   filename,
+		})
+	}
+	return templates, nil
+}
+
+// compileTemplateSpec 将模板规范构建为一个原始IP报文，地址留空由发送器替换
+func compileTemplateSpec(spec templateSpec, baseDir string, rng *rand.Rand) (gopacket.Packet, error) {
+	if len(spec.Layers) == 0 {
+		return nil, fmt.Errorf("模板没有定义任何层")
+	}
+
+	var stack []gopacket.SerializableLayer
+	var network gopacket.NetworkLayer
+	var ip4 *layers.IPv4
+	var ip6 *layers.IPv6
+	for i, l := range spec.Layers {
+		layerType := strings.ToLower(l.Type)
+		if (i == 0) != (layerType == "ipv4" || layerType == "ipv6") {
+			return nil, fmt.Errorf("第一层必须是 ipv4 或 ipv6，且只能有一个IP层")
+		}
+		switch layerType {
+		case "ipv4":
+			ip4 = &layers.IPv4{
+				Version: 4,
+				TTL:     orDefault8(l.TTL, 64),
+				TOS:     l.TOS,
+				Id:      l.ID,
+				SrcIP:   net.IPv4zero,
+				DstIP:   net.IPv4zero,
+			}
+			if l.DF {
+				ip4.Flags = layers.IPv4DontFragment
+			}
+			network = ip4
+			stack = append(stack, ip4)
+		case "ipv6":
+			ip6 = &layers.IPv6{
+				Version:      6,
+				HopLimit:     orDefault8(l.TTL, 64),
+				TrafficClass: l.TOS,
+				FlowLabel:    l.FlowLabel,
+				SrcIP:        net.IPv6zero,
+				DstIP:        net.IPv6zero,
+			}
+			network = ip6
+			stack = append(stack, ip6)
+		case "tcp":
+			tcp := &layers.TCP{
+				SrcPort: layers.TCPPort(ephemeralPort(l.SrcPort, rng)),
+				DstPort: layers.TCPPort(l.DstPort),
+				Seq:     l.Seq,
+				Ack:     l.Ack,
+				Window:  orDefault16(l.Window, 64240),
+			}
+			if err := setTCPFlags(tcp, l.Flags); err != nil {
+				return nil, err
+			}
+			for _, o := range l.Options {
+				opt, err := o.build()
+				if err != nil {
+					return nil, err
+				}
+				tcp.Options = append(tcp.Options, opt)
+			}
+			stack = append(stack, tcp)
+		case "udp":
+			stack = append(stack, &layers.UDP{
+				SrcPort: layers.UDPPort(ephemeralPort(l.SrcPort, rng)),
+				DstPort: layers.UDPPort(l.DstPort),
+			})
+		case "icmpv4":
+			stack = append(stack, &layers.ICMPv4{
+				TypeCode: layers.CreateICMPv4TypeCode(l.ICMPType, l.ICMPCode),
+				Id:       l.ID,
+				Seq:      uint16(l.Seq),
+			})
+		case "icmpv6":
+			stack = append(stack, &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(l.ICMPType, l.ICMPCode)})
+			if l.ICMPType == layers.ICMPv6TypeEchoRequest || l.ICMPType == layers.ICMPv6TypeEchoReply {
+				stack = append(stack, &layers.ICMPv6Echo{Identifier: l.ID, SeqNumber: uint16(l.Seq)})
+			}
+		case "sctp":
+			stack = append(stack, &layers.SCTP{
+				SrcPort: layers.SCTPPort(ephemeralPort(l.SrcPort, rng)),
+				DstPort: layers.SCTPPort(l.DstPort),
+			})
+			switch strings.ToLower(l.Chunk) {
+			case "init":
+				stack = append(stack, &layers.SCTPInit{
+					SCTPChunk:                      layers.SCTPChunk{Type: layers.SCTPChunkTypeInit},
+					InitiateTag:                    rng.Uint32() | 1,
+					AdvertisedReceiverWindowCredit: 65535,
+					OutboundStreams:                10,
+					InboundStreams:                 65535,
+					InitialTSN:                     rng.Uint32(),
+				})
+			case "":
+			default:
+				return nil, fmt.Errorf("不支持的SCTP块类型: %s", l.Chunk)
+			}
+		default:
+			return nil, fmt.Errorf("不支持的层类型: %s", l.Type)
+		}
+	}
+
+	// 根据第二层设置IP协议字段，并为依赖伪首部的层关联网络层
+	if len(stack) > 1 {
+		proto, err := specProtocol(stack[1])
+		if err != nil {
+			return nil, err
+		}
+		if ip4 != nil {
+			ip4.Protocol = proto
+		} else {
+			ip6.NextHeader = proto
+		}
+	}
+	for _, layer := range stack {
+		if c, ok := layer.(checksumLayer); ok {
+			if err := c.SetNetworkLayerForChecksum(network); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if spec.Payload != nil {
+		payload, err := spec.Payload.bytes(baseDir)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, gopacket.Payload(payload))
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buffer, options, stack...); err != nil {
+		return nil, fmt.Errorf("序列化模板时出错: %w", err)
+	}
+	data := buffer.Bytes()
+	packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+	if ip6 != nil {
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+	}
+	packet.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	return packet, nil
+}
+
+// specProtocol 返回紧随IP层的层对应的IP协议号
+func specProtocol(layer gopacket.SerializableLayer) (layers.IPProtocol, error) {
+	switch layer.(type) {
+	case *layers.TCP:
+		return layers.IPProtocolTCP, nil
+	case *layers.UDP:
+		return layers.IPProtocolUDP, nil
+	case *layers.ICMPv4:
+		return layers.IPProtocolICMPv4, nil
+	case *layers.ICMPv6:
+		return layers.IPProtocolICMPv6, nil
+	case *layers.SCTP:
+		return layers.IPProtocolSCTP, nil
+	}
+	return 0, fmt.Errorf("IP层之后不能是 %s", layer.LayerType())
+}
+
+// setTCPFlags 根据逗号分隔的标志位名称设置TCP标志
+func setTCPFlags(tcp *layers.TCP, flags string) error {
+	for _, f := range strings.Split(flags, ",") {
+		switch strings.ToUpper(strings.TrimSpace(f)) {
+		case "":
+		case "FIN":
+			tcp.FIN = true
+		case "SYN":
+			tcp.SYN = true
+		case "RST":
+			tcp.RST = true
+		case "PSH":
+			tcp.PSH = true
+		case "ACK":
+			tcp.ACK = true
+		case "URG":
+			tcp.URG = true
+		case "ECE":
+			tcp.ECE = true
+		case "CWR":
+			tcp.CWR = true
+		case "NS":
+			tcp.NS = true
+		default:
+			return fmt.Errorf("无效的TCP标志位: %s", f)
+		}
+	}
+	return nil
+}
+
+// build 将TCP选项规范转换为gopacket的TCP选项
+func (o tcpOption) build() (layers.TCPOption, error) {
+	switch strings.ToLower(o.Kind) {
+	case "mss":
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(o.Value))
+		return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionData: data}, nil
+	case "wscale":
+		return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionData: []byte{byte(o.Value)}}, nil
+	case "sack_permitted":
+		return layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted}, nil
+	case "timestamps":
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data[:4], o.TSval)
+		binary.BigEndian.PutUint32(data[4:], o.TSecr)
+		return layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionData: data}, nil
+	case "nop":
+		return layers.TCPOption{OptionType: layers.TCPOptionKindNop}, nil
+	case "eol":
+		return layers.TCPOption{OptionType: layers.TCPOptionKindEndList}, nil
+	}
+
+	var kind uint8
+	if _, err := fmt.Sscanf(o.Kind, "%d", &kind); err != nil {
+		return layers.TCPOption{}, fmt.Errorf("不支持的TCP选项: %s", o.Kind)
+	}
+	data, err := hex.DecodeString(o.Data)
+	if err != nil {
+		return layers.TCPOption{}, fmt.Errorf("TCP选项 %s 的数据不是有效的十六进制: %w", o.Kind, err)
+	}
+	return layers.TCPOption{OptionType: layers.TCPOptionKind(kind), OptionData: data}, nil
+}
+
+// bytes 返回载荷规范对应的字节
+func (p *payloadSpec) bytes(baseDir string) ([]byte, error) {
+	set := 0
+	for _, s := range []string{p.Hex, p.String, p.File} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("载荷只能指定 hex、string、file 中的一种")
+	}
+
+	switch {
+	case p.Hex != "":
+		data, err := hex.DecodeString(strings.Join(strings.Fields(p.Hex), ""))
+		if err != nil {
+			return nil, fmt.Errorf("载荷不是有效的十六进制: %w", err)
+		}
+		return data, nil
+	case p.File != "":
+		path := p.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取载荷文件时出错: %w", err)
+		}
+		return data, nil
+	}
+	return []byte(p.String), nil
+}
+
+// ephemeralPort 在端口未指定时随机返回一个临时端口
+func ephemeralPort(port uint16, rng *rand.Rand) uint16 {
+	if port != 0 {
+		return port
+	}
+	return uint16(32768 + rng.Intn(28232))
+}
+
+// orDefault8 在值为0时返回默认值
+func orDefault8(v, def uint8) uint8 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// orDefault16 在值为0时返回默认值
+func orDefault16(v, def uint16) uint16 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// parseVLANSpec 解析VLAN规范，支持单个ID (100) 或逗号分隔的QinQ堆叠标签 (100,200，外层在前)
+func parseVLANSpec(spec string) ([]uint16, error) {
+	var ids []uint16
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || id < 1 || id > 4094 {
+			return nil, fmt.Errorf("无效的VLAN ID: %s (有效范围 1-4094)", s)
+		}
+		ids = append(ids, uint16(id))
+	}
+	if len(ids) > 2 {
+		return nil, fmt.Errorf("最多支持两层VLAN标签 (QinQ): %s", spec)
+	}
+	return ids, nil
+}
+
+// buildVLANLayers 根据VLAN ID列表构建802.1Q标签层，并设置以太网层及各标签的类型字段
+func buildVLANLayers(ethLayer *layers.Ethernet, vlanIDs []uint16, payloadType layers.EthernetType) []*layers.Dot1Q {
+	tags := make([]*layers.Dot1Q, len(vlanIDs))
+	for i, id := range vlanIDs {
+		tags[i] = &layers.Dot1Q{VLANIdentifier: id, Type: payloadType}
+		if i > 0 {
+			tags[i-1].Type = layers.EthernetTypeDot1Q
+		}
+	}
+	if len(tags) > 1 {
+		// QinQ 的外层标签使用 802.1ad 以太网类型
+		ethLayer.EthernetType = layers.EthernetTypeQinQ
+	} else if len(tags) == 1 {
+		ethLayer.EthernetType = layers.EthernetTypeDot1Q
+	}
+	return tags
+}
+
+// reuseTemplateVLANLayers 保留模板中已有的VLAN标签，仅修正最内层标签指向的载荷类型
+func reuseTemplateVLANLayers(ethLayer *layers.Ethernet, templatePacket gopacket.Packet, tags []*layers.Dot1Q, payloadType layers.EthernetType) []*layers.Dot1Q {
+	if len(tags) == 0 {
+		return nil
+	}
+	ethLayer.EthernetType = layers.EthernetTypeDot1Q
+	if templateEth, ok := templatePacket.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		ethLayer.EthernetType = templateEth.EthernetType
+	}
+	tags[len(tags)-1].Type = payloadType
+	return tags
+}
+
+// templateVLANDepth 返回所有模板中VLAN标签的最大层数
+func templateVLANDepth(templates []PacketTemplate) int {
+	depth := 0
+	for _, template := range templates {
+		n := 0
+		for _, layer := range template.Packet.Layers() {
+			if layer.LayerType() == layers.LayerTypeDot1Q {
+				n++
+			}
+		}
+		if n > depth {
+			depth = n
+		}
+	}
+	return depth
+}
+
+// vlanAwareFilter 将BPF过滤表达式扩展为同时匹配未打标签和最多 depth 层VLAN标签的报文
+// 注意: libpcap 中每个 "vlan" 关键字都会使后续表达式的偏移量增加4字节，因此采用嵌套形式
+func vlanAwareFilter(expr string, depth int) string {
+	if depth <= 0 {
+		return expr
+	}
+	return fmt.Sprintf("%s or (vlan and (%s))", expr, vlanAwareFilter(expr, depth-1))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// 发送后端
+const (
+	txBackendPcap   = "pcap"   // 通过libpcap逐个报文发送
+	txBackendTXRing = "txring" // 通过AF_PACKET TPACKET_V2 发送环批量发送 (仅Linux)
+)
+
+// packetWriter 是发送报文的后端
+// WritePacketData 可以只将报文排队，Flush 保证已排队的报文全部提交给内核
+// Backpressure 返回内核发送队列已满 (ENOBUFS、EAGAIN) 而被后端自行重试的累计次数，可被其他协程并发读取
+type packetWriter interface {
+	WritePacketData(data []byte) error
+	Flush() error
+	Backpressure() uint64
+	Close()
+}
+
+// pcapWriter 通过libpcap发送报文，每个报文一次系统调用
+type pcapWriter struct {
+	handle *pcap.Handle
+}
+
+func (w *pcapWriter) WritePacketData(data []byte) error {
+	return w.handle.WritePacketData(data)
+}
+
+func (w *pcapWriter) Flush() error {
+	return nil
+}
+
+// Backpressure 总是返回0: libpcap发送失败时直接由 WritePacketData 返回错误
+func (w *pcapWriter) Backpressure() uint64 {
+	return 0
+}
+
+func (w *pcapWriter) Close() {
+	w.handle.Close()
+}
+
+// openPcapWriter 打开网络接口用于通过libpcap发送
+func openPcapWriter(ifaceName string) (*pcapWriter, error) {
+	handle, err := pcap.OpenLive(ifaceName, 1600, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	return &pcapWriter{handle: handle}, nil
+}
+
+// openPacketWriter 按指定的后端打开发送接口，发送环不可用时回退到libpcap
+// 返回实际使用的后端名称
+func openPacketWriter(backend, ifaceName string, batch int) (packetWriter, string, error) {
+	switch backend {
+	case txBackendPcap:
+	case txBackendTXRing:
+		w, err := openTXRingWriter(ifaceName, batch)
+		if err == nil {
+			return w, txBackendTXRing, nil
+		}
+		log.Printf("警告: 无法在接口 %s 上创建发送环: %v，回退到libpcap发送。", ifaceName, err)
+	default:
+		return nil, "", fmt.Errorf("不支持的发送后端: %s (可选: %s, %s)", backend, txBackendPcap, txBackendTXRing)
+	}
+	w, err := openPcapWriter(ifaceName)
+	if err != nil {
+		return nil, "", err
+	}
+	return w, txBackendPcap, nil
+}
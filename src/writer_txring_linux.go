@@ -0,0 +1,215 @@
+//go:build linux
+
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// 发送环中的槽位数量
+	txRingFrames = 4096
+	// 槽位中帧数据的偏移: TPACKET_ALIGN(sizeof(struct tpacket2_hdr))
+	txRingDataOffset = unix.SizeofTpacket2Hdr
+	// 等待槽位释放的超时时间 (毫秒)
+	txRingPollTimeout = 1000
+)
+
+// txRingWriter 通过AF_PACKET TPACKET_V2 发送环批量发送报文
+// 报文被复制到与内核共享的环形缓冲区中，每 batch 个报文才调用一次 sendto 通知内核发送
+type txRingWriter struct {
+	fd        int
+	ring      []byte
+	frameSize int
+	frameNum  int
+	next      int // 下一个可写入的槽位
+	pending   int // 已排队但尚未通知内核的报文数
+	batch     int
+	retries   atomic.Uint64 // 内核发送队列已满而重试的次数
+}
+
+// openTXRingWriter 在指定接口上创建发送环
+func openTXRingWriter(ifaceName string, batch int) (*txRingWriter, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	if batch < 1 {
+		batch = 1
+	}
+
+	// 创建和绑定时协议号均为0: 内核不会为套接字注册接收钩子，因此它只用于发送，不会复制接口上收发的报文
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("创建AF_PACKET套接字失败: %v", err)
+	}
+	w := &txRingWriter{fd: fd, batch: batch}
+	if err := w.setup(iface); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if w.batch > w.frameNum {
+		w.batch = w.frameNum
+	}
+	return w, nil
+}
+
+// setup 设置TPACKET版本、创建并映射发送环，然后绑定到接口
+func (w *txRingWriter) setup(iface *net.Interface) error {
+	if err := unix.SetsockoptInt(w.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V2); err != nil {
+		return fmt.Errorf("设置TPACKET_V2失败: %v", err)
+	}
+	// 丢弃格式错误的帧而不是中止发送
+	if err := unix.SetsockoptInt(w.fd, unix.SOL_PACKET, unix.PACKET_LOSS, 1); err != nil {
+		return fmt.Errorf("设置PACKET_LOSS失败: %v", err)
+	}
+	// 绕过流量控制队列以提高发送速率，旧内核不支持时忽略
+	unix.SetsockoptInt(w.fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1)
+
+	// 槽位大小为能容纳 MTU、以太网头、两层VLAN标签和帧头的最小的2的幂，每个块至少64KB且为槽位大小的整数倍
+	frameSize := 2048
+	for frameSize < txRingDataOffset+iface.MTU+22 {
+		frameSize <<= 1
+	}
+	blockSize := 1 << 16
+	if blockSize < frameSize {
+		blockSize = frameSize
+	}
+	if pageSize := os.Getpagesize(); blockSize%pageSize != 0 {
+		return fmt.Errorf("块大小 %d 不是页大小 %d 的整数倍", blockSize, pageSize)
+	}
+	req := unix.TpacketReq{
+		Block_size: uint32(blockSize),
+		Block_nr:   uint32(txRingFrames * frameSize / blockSize),
+		Frame_size: uint32(frameSize),
+		Frame_nr:   txRingFrames,
+	}
+	if err := unix.SetsockoptTpacketReq(w.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &req); err != nil {
+		return fmt.Errorf("创建发送环失败: %v", err)
+	}
+	ring, err := unix.Mmap(w.fd, 0, int(req.Block_size*req.Block_nr), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("映射发送环失败: %v", err)
+	}
+	w.ring, w.frameSize, w.frameNum = ring, frameSize, txRingFrames
+
+	// 绑定时不能使用 ETH_P_ALL，否则每个发送套接字都会接收接口上的全部报文
+	if err := unix.Bind(w.fd, &unix.SockaddrLinklayer{Ifindex: iface.Index}); err != nil {
+		return fmt.Errorf("绑定接口 %s 失败: %v", iface.Name, err)
+	}
+	return nil
+}
+
+// slotStatus 返回槽位头部中状态字段的指针，该字段由内核并发修改
+func (w *txRingWriter) slotStatus(slot int) *uint32 {
+	return &(*unix.Tpacket2Hdr)(unsafe.Pointer(&w.ring[slot*w.frameSize])).Status
+}
+
+// WritePacketData 将报文复制到下一个空闲槽位，排队满 batch 个报文后通知内核发送
+func (w *txRingWriter) WritePacketData(data []byte) error {
+	if len(data) > w.frameSize-txRingDataOffset {
+		return fmt.Errorf("报文长度 %d 超过发送环槽位容量 %d", len(data), w.frameSize-txRingDataOffset)
+	}
+
+	status := w.slotStatus(w.next)
+	for {
+		s := atomic.LoadUint32(status)
+		if s == unix.TP_STATUS_AVAILABLE || s == unix.TP_STATUS_WRONG_FORMAT {
+			break
+		}
+		// 环已满: 通知内核发送已排队的报文，然后等待槽位释放
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := w.wait(); err != nil {
+			return err
+		}
+	}
+
+	base := w.next * w.frameSize
+	copy(w.ring[base+txRingDataOffset:], data)
+	hdr := (*unix.Tpacket2Hdr)(unsafe.Pointer(&w.ring[base]))
+	hdr.Len = uint32(len(data))
+	hdr.Snaplen = uint32(len(data))
+	atomic.StoreUint32(status, unix.TP_STATUS_SEND_REQUEST)
+
+	w.next = (w.next + 1) % w.frameNum
+	w.pending++
+	if w.pending >= w.batch {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush 通知内核发送全部已排队的报文，阻塞直到内核处理完毕
+func (w *txRingWriter) Flush() error {
+	if w.pending == 0 {
+		return nil
+	}
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(w.fd), 0, 0, 0, 0, 0)
+		switch errno {
+		case 0:
+			w.pending = 0
+			return nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN, unix.ENOBUFS:
+			// 网卡队列已满，等待后重试
+			w.retries.Add(1)
+			if err := w.wait(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("发送环提交失败: %v", errno)
+		}
+	}
+}
+
+// Backpressure 返回内核发送队列已满而重试的次数
+func (w *txRingWriter) Backpressure() uint64 {
+	return w.retries.Load()
+}
+
+// wait 等待套接字可写 (即发送环中有槽位被释放)
+func (w *txRingWriter) wait() error {
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLOUT}}
+	if _, err := unix.Poll(fds, txRingPollTimeout); err != nil && err != unix.EINTR {
+		return fmt.Errorf("等待发送环失败: %v", err)
+	}
+	return nil
+}
+
+// Close 发送剩余的报文并释放发送环
+func (w *txRingWriter) Close() {
+	if w.ring != nil {
+		w.Flush()
+		unix.Munmap(w.ring)
+		w.ring = nil
+	}
+	unix.Close(w.fd)
+}
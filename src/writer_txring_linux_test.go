@@ -0,0 +1,132 @@
+//go:build linux
+
+/*
+Copyright (C) 2025 ZqinKing <ZqinKing23@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 测试使用的以太网类型 (IEEE 802 本地实验用)，网络字节序
+const txRingTestEtherType = 0x88b5
+
+// setupTestVeth 创建一对临时的veth接口，无权限或系统不支持时跳过测试
+func setupTestVeth(t *testing.T, a, b string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("需要root权限")
+	}
+	if out, err := exec.Command("ip", "link", "add", a, "type", "veth", "peer", "name", b).CombinedOutput(); err != nil {
+		t.Skipf("无法创建veth接口: %v: %s", err, out)
+	}
+	t.Cleanup(func() { exec.Command("ip", "link", "del", a).Run() })
+	for _, name := range []string{a, b} {
+		if out, err := exec.Command("ip", "link", "set", name, "up").CombinedOutput(); err != nil {
+			t.Fatalf("无法启用接口 %s: %v: %s", name, err, out)
+		}
+	}
+}
+
+// openTestPacketSocket 在接口上打开只接收测试以太网类型的AF_PACKET套接字
+func openTestPacketSocket(t *testing.T, ifaceName string) int {
+	t.Helper()
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto := int(txRingTestEtherType>>8 | txRingTestEtherType&0xff<<8)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: uint16(proto), Ifindex: iface.Index}); err != nil {
+		t.Fatal(err)
+	}
+	// 接收缓冲区须能容纳全部测试报文，否则报文会在读取前被丢弃
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	tv := unix.NsecToTimeval(int64(time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// testFrame 构造带序号的测试帧
+func testFrame(seq uint32) []byte {
+	frame := make([]byte, 64)
+	copy(frame[0:6], net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01})
+	binary.BigEndian.PutUint16(frame[12:], txRingTestEtherType)
+	binary.BigEndian.PutUint32(frame[14:], seq)
+	return frame
+}
+
+func TestTXRingWriterSendsOnVeth(t *testing.T) {
+	const txIface, peerIface = "pcstx0", "pcstx1"
+	setupTestVeth(t, txIface, peerIface)
+	peer := openTestPacketSocket(t, peerIface)
+
+	const count = 300 // 不是批量大小的整数倍，最后一批由 Flush 提交
+	w, err := openTXRingWriter(txIface, 64)
+	if err != nil {
+		t.Fatalf("创建发送环失败: %v", err)
+	}
+	defer w.Close()
+	for i := uint32(0); i < count; i++ {
+		if err := w.WritePacketData(testFrame(i)); err != nil {
+			t.Fatalf("发送第 %d 个报文失败: %v", i, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("提交发送环失败: %v", err)
+	}
+
+	buf := make([]byte, 2048)
+	for i := uint32(0); i < count; i++ {
+		n, _, err := unix.Recvfrom(peer, buf, 0)
+		if err != nil {
+			t.Fatalf("对端只收到 %d/%d 个报文: %v", i, count, err)
+		}
+		if want := testFrame(i); !bytes.Equal(buf[:n], want) {
+			t.Fatalf("对端收到的第 %d 个报文不一致\n收到: %x\n期望: %x", i, buf[:n], want)
+		}
+	}
+
+	// 发送套接字不应接收接口上的报文: 从对端发送一个报文，发送环的套接字上应无数据可读
+	peerIndex, _ := net.InterfaceByName(peerIface)
+	if err := unix.Sendto(peer, testFrame(count), 0, &unix.SockaddrLinklayer{Ifindex: peerIndex.Index}); err != nil {
+		t.Fatalf("对端发送报文失败: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, _, err := unix.Recvfrom(w.fd, buf, unix.MSG_DONTWAIT); err != unix.EAGAIN {
+		t.Errorf("发送环的套接字接收到了报文 (长度 %d, 错误 %v)", n, err)
+	}
+}